@@ -0,0 +1,114 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// A zip or tar.gz backup opened for reading.
+type archive struct {
+	zip *zip.Reader // nil for tar.gz backups.
+	// The tar.gz, which is decompressed from the start by every walk because tar can only be read in order.
+	tarGz     io.ReaderAt
+	tarGzSize int64
+}
+
+// An entry of an archive. `open` may only be called while handling the entry.
+type archiveEntry struct {
+	name     string
+	modified time.Time
+	isDir    bool
+	mode     os.FileMode // Permission bits of tar.gz entries. 0 for zip entries.
+	zipFile  *zip.File   // nil for tar.gz entries.
+	open     func() (io.ReadCloser, error)
+	// Target of symlink entries. Empty for other entries.
+	linkTarget string
+}
+
+// Opens the zip in `r`, or the tar.gz if `tarGz` is set.
+func newArchive(r io.ReaderAt, size int64, tarGz bool) (*archive, error) {
+	if tarGz {
+		return &archive{tarGz: r, tarGzSize: size}, nil
+	}
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return &archive{zip: zipReader}, nil
+}
+
+// Calls `fn` with every file, directory and symlink entry in order. Stops at the first error returned by `fn` or from reading the archive.
+func (a *archive) walk(fn func(entry archiveEntry) error) error {
+	if a.zip != nil {
+		for _, f := range a.zip.File {
+			entry := archiveEntry{
+				name:     f.Name,
+				modified: f.Modified,
+				isDir:    f.FileInfo().IsDir(),
+				zipFile:  f,
+				open:     func() (io.ReadCloser, error) { return f.Open() },
+			}
+			// The contents of symlink entries are their targets.
+			if f.Mode()&os.ModeSymlink != 0 {
+				target, err := readZipFile(f)
+				if err != nil {
+					return err
+				}
+				entry.linkTarget = string(target)
+			}
+			err := fn(entry)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	gzipReader, err := gzip.NewReader(io.NewSectionReader(a.tarGz, 0, a.tarGzSize))
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Backups only contain files, directories and symlinks.
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir && header.Typeflag != tar.TypeSymlink {
+			continue
+		}
+		entry := archiveEntry{
+			name:     header.Name,
+			modified: header.ModTime,
+			isDir:    header.Typeflag == tar.TypeDir,
+			mode:     os.FileMode(header.Mode).Perm(),
+			open:     func() (io.ReadCloser, error) { return ioutil.NopCloser(tarReader), nil },
+		}
+		if header.Typeflag == tar.TypeSymlink {
+			entry.linkTarget = header.Linkname
+		}
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
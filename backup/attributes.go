@@ -0,0 +1,32 @@
+package backup
+
+import "os"
+
+// MS-DOS attributes stored in the low byte of a zip entry's external attributes. They have the same values as the Windows file attributes.
+const (
+	dosReadOnly  = 0x01
+	dosHidden    = 0x02
+	dosSystem    = 0x04
+	dosDirectory = 0x10
+	dosArchive   = 0x20
+)
+
+// Reapplies the read-only, hidden and system attributes of a zip entry to `dstPath`, or the permissions of a tar.gz entry.
+// Only zip entries created by MS-DOS compatible archivers like this one store attributes this way.
+func restoreAttributes(entry archiveEntry, dstPath string) error {
+	f := entry.zipFile
+	if f == nil {
+		if entry.mode == 0 {
+			return nil
+		}
+		return os.Chmod(dstPath, entry.mode)
+	}
+	if f.CreatorVersion>>8 != 0 {
+		return nil
+	}
+	attributes := f.ExternalAttrs & (dosReadOnly | dosHidden | dosSystem)
+	if attributes == 0 {
+		return nil
+	}
+	return setFileAttributes(dstPath, attributes)
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+
+package backup
+
+import "os"
+
+// Returns the read-only attribute of a file, which is the only one with an equivalent outside Windows.
+func fileAttributes(info os.FileInfo) uint32 {
+	if info.Mode().Perm()&0222 == 0 {
+		return dosReadOnly
+	}
+	return 0
+}
+
+// Removes write permission from the file at `path` if `attributes` includes read-only. Other attributes are ignored.
+func setFileAttributes(path string, attributes uint32) error {
+	if attributes&dosReadOnly == 0 {
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, info.Mode().Perm()&^0222)
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package backup
+
+import (
+	"os"
+	"syscall"
+)
+
+// Returns the read-only, hidden, system and archive attributes of a file.
+func fileAttributes(info os.FileInfo) uint32 {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return 0
+	}
+	return data.FileAttributes & (dosReadOnly | dosHidden | dosSystem | dosArchive)
+}
+
+// Adds `attributes` to the file at `path`.
+func setFileAttributes(path string, attributes uint32) error {
+	pathPtr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	current, err := syscall.GetFileAttributes(pathPtr)
+	if err != nil {
+		return err
+	}
+	return syscall.SetFileAttributes(pathPtr, current|attributes)
+}
@@ -0,0 +1,249 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const b2AuthorizeURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+// B2 large files have at most 10000 parts.
+const b2MaxPartCount = 10000
+
+type b2Authorization struct {
+	AccountID           string `json:"accountId"`
+	AuthorizationToken  string `json:"authorizationToken"`
+	APIURL              string `json:"apiUrl"`
+	RecommendedPartSize int64  `json:"recommendedPartSize"`
+	Allowed             struct {
+		BucketID   string `json:"bucketId"`
+		BucketName string `json:"bucketName"`
+	} `json:"allowed"`
+}
+
+type b2UploadURL struct {
+	UploadURL          string `json:"uploadUrl"`
+	AuthorizationToken string `json:"authorizationToken"`
+}
+
+// Uploads the file at `filePath` to the configured B2 bucket with the B2 native API.
+// Files larger than the recommended part size are uploaded in parts with the large file API so they are never read fully into memory.
+// If `sha256Hex` is set the upload is abandoned unless the file's contents have that SHA-256. B2 checks the SHA-1 of each upload.
+func b2Upload(ctx context.Context, config *Config, filePath, sha256Hex string) error {
+	if config.B2Bucket == "" {
+		return errors.New("No B2 bucket for upload.")
+	}
+	fileName := strings.TrimPrefix(path.Join(config.B2Prefix, filepath.Base(filePath)), "/")
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Authorize.
+	request, err := http.NewRequestWithContext(ctx, "GET", b2AuthorizeURL, nil)
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(config.B2KeyID, config.B2ApplicationKey)
+	var auth b2Authorization
+	err = b2Do(request, "b2_authorize_account", &auth)
+	if err != nil {
+		return err
+	}
+	bucketID, err := b2BucketID(ctx, &auth, config.B2Bucket)
+	if err != nil {
+		return err
+	}
+
+	partSize := auth.RecommendedPartSize
+	if info.Size()/b2MaxPartCount >= partSize {
+		partSize = info.Size()/b2MaxPartCount + 1
+	}
+	limiter := newRateLimiter(config.UploadMaxBytesPerSecond)
+	fileHash := sha256.New()
+	check := func() error {
+		return checkUploadSHA256(filePath, fileHash, sha256Hex)
+	}
+	if info.Size() <= partSize {
+		var uploadURL b2UploadURL
+		err = b2Call(ctx, &auth, "b2_get_upload_url", map[string]string{"bucketId": bucketID}, &uploadURL)
+		if err != nil {
+			return err
+		}
+		_, err = b2UploadData(ctx, &uploadURL, io.NewSectionReader(file, 0, info.Size()), limiter, fileHash, check, func(header http.Header) {
+			header.Set("X-Bz-File-Name", awsURIEncode(fileName, true)) // B2 file names are percent encoded the same way as S3 keys.
+			header.Set("Content-Type", "b2/x-auto")
+		})
+		return err
+	}
+
+	// Start large file.
+	var startResult struct {
+		FileID string `json:"fileId"`
+	}
+	err = b2Call(ctx, &auth, "b2_start_large_file", map[string]string{
+		"bucketId":    bucketID,
+		"fileName":    fileName,
+		"contentType": "b2/x-auto",
+	}, &startResult)
+	if err != nil {
+		return err
+	}
+	err = b2UploadParts(ctx, &auth, startResult.FileID, file, info.Size(), partSize, limiter, fileHash, check)
+	if err != nil {
+		// Cancel so the bucket isn't charged for the parts. The upload error is more useful than any cancel error.
+		// The cancel is not cancelled with `ctx` because it is still needed when the upload was cancelled.
+		b2Call(context.Background(), &auth, "b2_cancel_large_file", map[string]string{"fileId": startResult.FileID}, nil)
+		return err
+	}
+	return nil
+}
+
+// Uploads `file` in parts then finishes the large file if `check` accepts the contents written to `fileHash`.
+func b2UploadParts(ctx context.Context, auth *b2Authorization, fileID string, file io.ReaderAt, size, partSize int64, limiter *rateLimiter, fileHash io.Writer, check func() error) error {
+	var uploadURL b2UploadURL
+	err := b2Call(ctx, auth, "b2_get_upload_part_url", map[string]string{"fileId": fileID}, &uploadURL)
+	if err != nil {
+		return err
+	}
+	partSHA1s := make([]string, 0)
+	for offset := int64(0); offset < size; offset += partSize {
+		n := partSize
+		if size-offset < n {
+			n = size - offset
+		}
+		partNumber := len(partSHA1s) + 1
+		part := io.NewSectionReader(file, offset, n)
+		hash, err := b2UploadData(ctx, &uploadURL, part, limiter, fileHash, nil, func(header http.Header) {
+			header.Set("X-Bz-Part-Number", strconv.Itoa(partNumber))
+		})
+		if err != nil {
+			return err
+		}
+		partSHA1s = append(partSHA1s, hash)
+	}
+	err = check()
+	if err != nil {
+		return err
+	}
+
+	return b2Call(ctx, auth, "b2_finish_large_file", map[string]interface{}{
+		"fileId":        fileID,
+		"partSha1Array": partSHA1s,
+	}, nil)
+}
+
+// Uploads the contents of `r` to `uploadURL` with the headers set by `setHeaders` and returns the hex encoded SHA-1 of the contents.
+// `r` is read twice, first to calculate the SHA-1 which B2 requires before the contents. The upload is no faster than `limiter` allows if it is not nil.
+// The first read is also written to `fileHash`, and the contents are only uploaded if `check` returns nil, unless it is nil.
+func b2UploadData(ctx context.Context, uploadURL *b2UploadURL, r *io.SectionReader, limiter *rateLimiter, fileHash io.Writer, check func() error, setHeaders func(http.Header)) (string, error) {
+	hash := sha1.New()
+	_, err := io.Copy(io.MultiWriter(hash, fileHash), r)
+	if err != nil {
+		return "", err
+	}
+	if check != nil {
+		err = check()
+		if err != nil {
+			return "", err
+		}
+	}
+	sha1Hex := hex.EncodeToString(hash.Sum(nil))
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", uploadURL.UploadURL, limiter.reader(ctx, r))
+	if err != nil {
+		return "", err
+	}
+	request.ContentLength = r.Size()
+	request.Header.Set("Authorization", uploadURL.AuthorizationToken)
+	request.Header.Set("X-Bz-Content-Sha1", sha1Hex)
+	setHeaders(request.Header)
+	return sha1Hex, b2Do(request, "upload", nil)
+}
+
+// Returns the ID of the bucket called `bucketName`.
+func b2BucketID(ctx context.Context, auth *b2Authorization, bucketName string) (string, error) {
+	// Keys restricted to a bucket say which one.
+	if auth.Allowed.BucketName == bucketName && auth.Allowed.BucketID != "" {
+		return auth.Allowed.BucketID, nil
+	}
+	var listResult struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+	err := b2Call(ctx, auth, "b2_list_buckets", map[string]string{
+		"accountId":  auth.AccountID,
+		"bucketName": bucketName,
+	}, &listResult)
+	if err != nil {
+		return "", err
+	}
+	if len(listResult.Buckets) == 0 {
+		return "", fmt.Errorf("B2 bucket %q does not exist.", bucketName)
+	}
+	return listResult.Buckets[0].BucketID, nil
+}
+
+// Calls the B2 API operation `operation` with `body` as JSON and decodes the response into `response` if it is not nil.
+func b2Call(ctx context.Context, auth *b2Authorization, operation string, body interface{}, response interface{}) error {
+	requestBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", auth.APIURL+"/b2api/v2/"+operation, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", auth.AuthorizationToken)
+	return b2Do(request, operation, response)
+}
+
+func b2Do(request *http.Request, operation string, response interface{}) error {
+	httpClient := &http.Client{}
+	httpResponse, err := httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("B2 request failed: %w", err)
+	}
+	defer httpResponse.Body.Close()
+	responseBody, err := ioutil.ReadAll(httpResponse.Body)
+	if err != nil {
+		return err
+	}
+	// If status code is not 2xx.
+	if httpResponse.StatusCode/100 != 2 {
+		return fmt.Errorf("B2 returned non-200 status code \"%d\" for %s.\n\nResponse body: \"%s\"", httpResponse.StatusCode, operation, string(responseBody))
+	}
+	if response == nil {
+		return nil
+	}
+	err = json.Unmarshal(responseBody, response)
+	if err != nil {
+		return fmt.Errorf("Unable to parse B2 %s response: %w", operation, err)
+	}
+	return nil
+}
@@ -0,0 +1,607 @@
+// Package backup zips sources to a directory, deleting old backups once a backup succeeds.
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+	// Embed the timezone database because Windows does not have one.
+	_ "time/tzdata"
+)
+
+// Result describes a backup.
+type Result struct {
+	ArchivePath         string // Empty unless the backup was completed. The first volume if the backup was split, or the directory of directory backups.
+	Incremental         bool   // Only contains files modified since the previous backup.
+	Directory           bool   // Backed up to a directory rather than an archive.
+	FileCount           int
+	ByteCount           int64 // Uncompressed.
+	CompressedByteCount int64 // Size of the archive. For directory backups, the size of the files copied rather than linked.
+	LinkedFileCount     int   // Files hard linked to the previous directory backup because they were unchanged.
+	DeferredFileCount   int   // Files skipped because they were modified within `Config.ExcludeModifiedWithinSeconds`.
+	Duration            time.Duration
+	Sources             []SourceResult // In the order of `Config.Sources`.
+	Errors              []error        // Includes the error returned by `Run`, if any.
+	Warnings            []string
+	Skipped             string // Why no backup was taken, if the newest backup was within `Config.MinIntervalHours`.
+}
+
+// SourceResult describes what was backed up from a source.
+type SourceResult struct {
+	Path                string
+	FileCount           int
+	ByteCount           int64 // Uncompressed.
+	CompressedByteCount int64 // Compressed size of the files, excluding zip headers. For directory backups, the size of the files copied rather than linked. Zero for dry runs.
+	LinkedFileCount     int
+}
+
+// Summary describes the size of the backup and how long it took, then the size of each source so sources that don't compress well stand out.
+func (r *Result) Summary() string {
+	if r.Skipped != "" {
+		return r.Skipped
+	}
+	if r.Directory {
+		summary := fmt.Sprintf("Backed up %d files totalling %d bytes (%d bytes copied, %d unchanged files linked) in %s.", r.FileCount, r.ByteCount, r.CompressedByteCount, r.LinkedFileCount, r.Duration.Round(time.Millisecond))
+		for _, source := range r.Sources {
+			summary += fmt.Sprintf("\n\t%s: %d files totalling %d bytes (%d bytes copied, %d unchanged files linked).", source.Path, source.FileCount, source.ByteCount, source.CompressedByteCount, source.LinkedFileCount)
+		}
+		return summary + r.deferredSummary()
+	}
+	summary := fmt.Sprintf("Backed up %d files totalling %d bytes (%d bytes compressed, ratio %s) in %s.", r.FileCount, r.ByteCount, r.CompressedByteCount, compressionRatio(r.CompressedByteCount, r.ByteCount), r.Duration.Round(time.Millisecond))
+	for _, source := range r.Sources {
+		summary += fmt.Sprintf("\n\t%s: %d files totalling %d bytes (%d bytes compressed, ratio %s).", source.Path, source.FileCount, source.ByteCount, source.CompressedByteCount, compressionRatio(source.CompressedByteCount, source.ByteCount))
+	}
+	return summary + r.deferredSummary()
+}
+
+func (r *Result) deferredSummary() string {
+	if r.DeferredFileCount == 0 {
+		return ""
+	}
+	return fmt.Sprintf("\n%d recently modified files were left for the next backup.", r.DeferredFileCount)
+}
+
+// Returns `compressed` as a percentage of `uncompressed`.
+func compressionRatio(compressed, uncompressed int64) string {
+	if uncompressed == 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.1f%%", float64(compressed)/float64(uncompressed)*100)
+}
+
+// Run backs up `config.Sources` to the `backups` directory within `config.DestinationDir`.
+// Old backups are only deleted if no errors occurred. Errors are not reported; see `Report`.
+// The partial backup is deleted if `ctx` is done before the backup is complete.
+// The returned error is the one that stopped the backup, which is also included in `Result.Errors`.
+// Metrics are written to `config.MetricsFilePath` afterwards if it is set.
+func Run(ctx context.Context, config Config) (Result, error) {
+	start := time.Now()
+	e := newErrorHandler(config.logger())
+	e.errLogger = config.ErrorLogger
+	var result Result
+	err := e.catch(func() {
+		run(ctx, e, &config, &result, start)
+	})
+	result.Duration = time.Since(start)
+	result.Errors = e.errs
+	result.Warnings = e.warnings
+	// A skipped run has nothing to measure and mustn't replace the metrics of the backup that made it unnecessary.
+	if config.MetricsFilePath != "" && result.Skipped == "" {
+		e.printIfErr(writeMetrics(&config, result, time.Now()))
+		result.Errors = e.errs
+	}
+	return result, err
+}
+
+// DryRun logs what `Run` would back up without writing a backup or deleting old backups.
+// The returned `Result` has counts of what would be backed up.
+func DryRun(ctx context.Context, config Config) (Result, error) {
+	start := time.Now()
+	e := newErrorHandler(config.logger())
+	e.errLogger = config.ErrorLogger
+	var result Result
+	err := e.catch(func() {
+		prepare(e, &config)
+		since, err := incrementalSince(&config, config.DestinationDir, start)
+		e.panicIfErr(err)
+		if !since.IsZero() {
+			e.logger.Printf("Dry run: incremental backup of files modified since %s.", since)
+		}
+		for _, source := range config.Sources {
+			w := newWalker(nil, e, &config, source)
+			w.dryRun = true
+			w.since = since
+			errs := w.addSrc(ctx, source.Path, "")
+			for _, err := range errs {
+				e.print(err)
+			}
+			result.FileCount += w.fileCount
+			result.ByteCount += w.byteCount
+			result.Sources = append(result.Sources, SourceResult{
+				Path:      source.Path,
+				FileCount: w.fileCount,
+				ByteCount: w.byteCount,
+			})
+		}
+		e.logger.Printf("Dry run: would back up %d files totalling %d bytes.", result.FileCount, result.ByteCount)
+	})
+	result.Duration = time.Since(start)
+	result.Errors = e.errs
+	result.Warnings = e.warnings
+	return result, err
+}
+
+// Applies defaults to `config` and checks its sources exist.
+func prepare(e *errorHandler, config *Config) {
+	e.panicIfErr(config.setDefaults())
+
+	// Check sources exist before doing any work so renamed paths are obvious.
+	missingSources := make([]string, 0)
+	for _, source := range config.Sources {
+		_, err := os.Stat(source.Path)
+		if os.IsNotExist(err) {
+			e.warn(fmt.Sprintf("Source path %q does not exist.", source.Path))
+			missingSources = append(missingSources, source.Path)
+		}
+	}
+	if config.FailOnMissingSource && len(missingSources) > 0 {
+		e.panic(fmt.Errorf("%d source paths do not exist: %q. Aborting because failOnMissingSource is set.", len(missingSources), missingSources))
+	}
+}
+
+func run(ctx context.Context, e *errorHandler, config *Config, result *Result, start time.Time) {
+	l := e.logger
+
+	if config.DestinationDir == "" {
+		e.panic(errors.New("No destination directory."))
+	}
+	dstDirPath, err := filepath.Abs(config.DestinationDir)
+	e.panicIfErr(err)
+
+	prepare(e, config)
+
+	encryptionPassword := config.EncryptionPassword
+	if encryptionPassword == "" && config.EncryptionPasswordEnv != "" {
+		encryptionPassword = os.Getenv(config.EncryptionPasswordEnv)
+		if encryptionPassword == "" {
+			e.panic(fmt.Errorf("Environment variable %q from encryptionPasswordEnv is not set.", config.EncryptionPasswordEnv))
+		}
+	}
+
+	location, err := config.location()
+	e.panicIfErr(err)
+
+	// Jobs are stored in subdirectories that may not exist yet.
+	err = os.MkdirAll(dstDirPath, os.ModeDir|os.ModePerm)
+	e.panicIfErr(err)
+
+	interrupted := errors.New("Backup interrupted. The partial backup was deleted and old backups will not be deleted.")
+
+	// Prevent overlapping runs from racing on the backups directory.
+	releaseLock, err := acquireLock(dstDirPath)
+	e.panicIfErr(err)
+	defer releaseLock()
+
+	// Create destination file name.
+	// The date is in the configured timezone for readability. The leading unix timestamp is used for sorting.
+	t := time.Now().In(location)
+	if config.MinIntervalHours > 0 {
+		skipped, err := withinMinInterval(e, config, filepath.Join(dstDirPath, "backups"), t)
+		e.panicIfErr(err)
+		if skipped != "" {
+			l.Print(skipped)
+			result.Skipped = skipped
+			return
+		}
+	}
+	since, err := incrementalSince(config, dstDirPath, t)
+	e.panicIfErr(err)
+	result.Incremental = !since.IsZero()
+	dstFileName, err := backupName(config, t)
+	e.panicIfErr(err)
+	if result.Incremental {
+		l.Printf("Incremental backup of files modified since %s.", since)
+		dstFileName += "-incremental"
+	}
+	if config.ArchiveFormat == "targz" {
+		dstFileName += ".tar.gz"
+	} else if config.BackupFormat != "directory" {
+		dstFileName += ".zip"
+	}
+	if encryptionPassword != "" {
+		dstFileName += ".enc"
+	}
+	backupsDirPath := filepath.Join(dstDirPath, "backups")
+	dstFilePath := filepath.Join(backupsDirPath, dstFileName)
+
+	// Create backup dir if not exist.
+	err = os.Mkdir(backupsDirPath, os.ModeDir|os.ModePerm)
+	if err != nil && !os.IsExist(err) {
+		e.panic(err)
+	}
+
+	// Check there is enough space for the backup before writing it.
+	// A full disk would leave a truncated backup.
+	var estimate int64
+	var estimateFiles int
+	for _, source := range config.Sources {
+		w := newWalker(nil, e, config, source)
+		w.since = since
+		// Errors will be reported when backing up.
+		w.addSrc(ctx, source.Path, "")
+		estimate += w.byteCount
+		estimateFiles += w.fileCount
+	}
+	if ctx.Err() != nil {
+		e.panic(interrupted)
+	}
+	freeBytes, err := freeSpace(backupsDirPath)
+	e.panicIfErr(err)
+	requiredBytes := int64(float64(estimate)*config.FreeSpaceSafetyFactor) + config.MinFreeBytes
+	if freeBytes < requiredBytes {
+		e.panic(fmt.Errorf("Not enough free space for backup. %d bytes are free but %d bytes are required (%d bytes of sources multiplied by freeSpaceSafetyFactor %g plus minFreeBytes %d). Old backups will not be deleted.", freeBytes, requiredBytes, estimate, config.FreeSpaceSafetyFactor, config.MinFreeBytes))
+	}
+
+	// Create destination file.
+	// Write to temporary files that are only renamed once complete so a failed backup is never mistaken for a good one.
+	complete := false
+	var dstFile *volumeWriter
+	var dstCounter *countingWriter
+	var dstEncrypter io.WriteCloser
+	var dstZip *zip.Writer
+	var dstGzip io.WriteCloser
+	var dstGzipCounter *countingWriter
+	var dstTar *tar.Writer
+	var dstSnapshot *snapshot
+	if config.BackupFormat == "directory" {
+		dstSnapshot, err = newSnapshot(e, config, backupsDirPath, dstFilePath)
+		e.panicIfErr(err)
+		defer func() {
+			if !complete {
+				dstSnapshot.remove()
+			}
+		}()
+		if dstSnapshot.previousPath != "" {
+			l.Printf("Linking unchanged files to %q.", filepath.Base(dstSnapshot.previousPath))
+		}
+	} else {
+		dstFile = newVolumeWriter(dstFilePath, config.SplitBytes)
+		defer func() {
+			if !complete {
+				dstFile.remove()
+			}
+		}()
+		dstCounter = &countingWriter{w: dstFile}
+		var dstWriter io.Writer = dstCounter
+		if encryptionPassword != "" {
+			dstEncrypter, err = newEncryptWriter(dstCounter, encryptionPassword)
+			e.panicIfErr(err)
+			dstWriter = dstEncrypter
+		}
+		if config.ArchiveFormat == "targz" {
+			level := gzip.DefaultCompression
+			if config.CompressionLevel != nil {
+				level = *config.CompressionLevel
+			}
+			dstGzipCounter = &countingWriter{w: dstWriter}
+			if config.CompressionThreads > 1 {
+				dstGzip, err = newParallelGzipWriter(dstGzipCounter, level, config.CompressionThreads)
+			} else {
+				dstGzip, err = gzip.NewWriterLevel(dstGzipCounter, level)
+			}
+			e.panicIfErr(err)
+			dstTar = tar.NewWriter(dstGzip)
+		} else {
+			dstZip = zip.NewWriter(dstWriter)
+		}
+		if dstZip != nil && (config.CompressionLevel != nil || config.CompressionThreads > 1) && compressionMethod(config) == zip.Deflate {
+			level := flate.DefaultCompression
+			if config.CompressionLevel != nil {
+				level = *config.CompressionLevel
+			}
+			dstZip.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+				return newDeflateWriter(w, level, config.CompressionThreads)
+			})
+		}
+	}
+
+	// Snapshot sources so files in use can be read.
+	sources := config.Sources
+	if config.UseVSS {
+		var deleteShadowCopies func()
+		sources, deleteShadowCopies = shadowSources(e, config.Sources)
+		defer deleteShadowCopies()
+	}
+
+	// Add sources to destination file.
+	// Sources are walked by a pool of `config.Concurrency` workers. Results are collected in source order so they are deterministic.
+	walkers := make([]*walker, len(sources))
+	sourceErrs := make([][]error, len(sources))
+	var zipMu *sync.Mutex
+	if config.Concurrency > 1 {
+		zipMu = &sync.Mutex{}
+	}
+	// Log progress while walking because large backups take hours.
+	var p *progress
+	stopProgress := func() {}
+	if !config.Quiet {
+		p = newProgress(estimateFiles, estimate)
+		stopProgress = p.logPeriodically(l)
+	}
+	// Stop walking once there are more than `config.MaxErrors` errors, e.g. when a source goes offline.
+	walkCtx, cancelWalk := context.WithCancel(ctx)
+	defer cancelWalk()
+	var errorCount atomic.Int64
+	errorCount.Store(int64(len(e.errs)))
+	onError := func() {
+		if config.MaxErrors > 0 && errorCount.Add(1) > int64(config.MaxErrors) {
+			cancelWalk()
+		}
+	}
+	sourceIndexes := make(chan int)
+	var wg sync.WaitGroup
+	for worker := 0; worker < config.Concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range sourceIndexes {
+				baseName := filepath.Base(config.Sources[i].Path)
+				w := newWalker(dstZip, e, config, sources[i])
+				w.tar = dstTar
+				w.gzipCounter = dstGzipCounter
+				w.snapshot = dstSnapshot
+				w.zipMu = zipMu
+				w.since = since
+				w.progress = p
+				w.onError = onError
+				walkers[i] = w
+				sourceErrs[i] = w.addSrc(walkCtx, sources[i].Path, fmt.Sprintf("source-%d:-%s", i+1, baseName)) // include number for simple collision prevention
+			}
+		}()
+	}
+	for i := range sources {
+		sourceIndexes <- i
+	}
+	close(sourceIndexes)
+	wg.Wait()
+	stopProgress()
+	if ctx.Err() != nil {
+		e.panic(interrupted)
+	}
+	m := manifest{Timestamp: t}
+	if result.Incremental {
+		m.Since = &since
+	}
+	errorLimitReached := walkCtx.Err() != nil
+	for i, w := range walkers {
+		for _, err := range sourceErrs[i] {
+			// Walks stopped by the error limit end with cancellation errors.
+			if errorLimitReached && errors.Is(err, context.Canceled) {
+				continue
+			}
+			e.print(err)
+		}
+		m.Files = append(m.Files, w.manifestFiles...)
+		result.FileCount += w.fileCount
+		result.ByteCount += w.byteCount
+	}
+	if errorLimitReached {
+		e.panic(fmt.Errorf("More than maxErrors %d errors occurred so the backup was stopped. The partial backup was deleted and old backups will not be deleted.", config.MaxErrors))
+	}
+	var volumePaths, volumeSums []string
+	if dstSnapshot != nil {
+		err = dstSnapshot.writeManifest(m)
+		e.panicIfErr(err)
+		err = dstSnapshot.commit()
+		e.panicIfErr(err)
+		complete = true
+		result.ArchivePath = dstFilePath
+		result.Directory = true
+	} else {
+		// Finish destination file.
+		if dstTar != nil {
+			err = writeTarManifest(dstTar, m)
+			e.panicIfErr(err)
+			err = dstTar.Close()
+			e.panicIfErr(err)
+			err = dstGzip.Close()
+			e.panicIfErr(err)
+		} else {
+			err = writeManifest(dstZip, m)
+			e.panicIfErr(err)
+			err = dstZip.Close()
+			e.panicIfErr(err)
+		}
+		if dstEncrypter != nil {
+			err = dstEncrypter.Close()
+			e.panicIfErr(err)
+		}
+		err = dstFile.Close()
+		e.panicIfErr(err)
+		volumePaths, err = dstFile.commit()
+		e.panicIfErr(err)
+		complete = true
+		result.ArchivePath = volumePaths[0]
+		result.CompressedByteCount = dstCounter.n
+		volumeSums = dstFile.sums
+	}
+	// Entries' compressed sizes are only known once the zip is closed.
+	for i, w := range walkers {
+		result.Sources = append(result.Sources, SourceResult{
+			Path:                config.Sources[i].Path,
+			FileCount:           w.fileCount,
+			ByteCount:           w.byteCount,
+			CompressedByteCount: w.compressedBytes(),
+			LinkedFileCount:     w.linkedCount,
+		})
+		if dstSnapshot != nil {
+			result.CompressedByteCount += w.compressedBytes()
+		}
+		result.LinkedFileCount += w.linkedCount
+		result.DeferredFileCount += w.deferredCount
+	}
+	result.Duration = time.Since(start)
+	l.Print(result.Summary())
+	// Everything that is copied to the extra destinations.
+	copyPaths := volumePaths
+	if dstSnapshot != nil {
+		copyPaths = []string{dstFilePath}
+	}
+	if config.WriteIndex {
+		err = writeIndex(dstFilePath+indexSuffix, m)
+		if err != nil {
+			e.warn(fmt.Sprintf("Unable to write index: %s", err))
+		} else {
+			copyPaths = append(copyPaths[:len(copyPaths):len(copyPaths)], dstFilePath+indexSuffix)
+		}
+	}
+
+	// Uploads check that each volume still has the checksum it was written with, and the checksum file is uploaded after the volumes.
+	uploadPaths := volumePaths
+	uploadSums := volumeSums
+	if len(volumePaths) > 0 {
+		checksumPath := dstFilePath + checksumSuffix
+		err = writeChecksums(checksumPath, volumePaths, volumeSums)
+		if err != nil {
+			e.print(fmt.Errorf("Unable to write checksum file: %w", err))
+		} else {
+			uploadPaths = append(uploadPaths[:len(uploadPaths):len(uploadPaths)], checksumPath)
+			uploadSums = append(uploadSums[:len(uploadSums):len(uploadSums)], "")
+			copyPaths = append(copyPaths[:len(copyPaths):len(copyPaths)], checksumPath)
+		}
+	}
+
+	// Upload backup.
+	if config.S3Enable {
+		for i, uploadPath := range uploadPaths {
+			l.Printf("Uploading %q to S3.", filepath.Base(uploadPath))
+			err := s3Upload(ctx, config, uploadPath, uploadSums[i])
+			e.printIfErr(err)
+		}
+	}
+	if config.B2Enable {
+		for i, uploadPath := range uploadPaths {
+			l.Printf("Uploading %q to B2.", filepath.Base(uploadPath))
+			err := b2Upload(ctx, config, uploadPath, uploadSums[i])
+			e.printIfErr(err)
+		}
+	}
+	if config.SFTPEnable {
+		for i, uploadPath := range uploadPaths {
+			l.Printf("Uploading %q to SFTP server.", filepath.Base(uploadPath))
+			err := sftpUpload(ctx, config, uploadPath, uploadSums[i])
+			e.printIfErr(err)
+		}
+	}
+
+	// Copy the backup to the extra destinations rather than backing up again so every destination has the same backup.
+	// A destination that can't be copied to is reported but doesn't stop the others or old backups being deleted from them.
+	backupErrs := e.errs[:len(e.errs):len(e.errs)]
+	copiedDirPaths := make([]string, 0, len(config.Destinations))
+	for _, destination := range config.Destinations {
+		if ctx.Err() != nil {
+			break
+		}
+		l.Printf("Copying backup to %q.", destination)
+		releaseDestination, err := copyToDestination(ctx, e, config, destination, copyPaths, m)
+		if err != nil {
+			e.print(fmt.Errorf("Unable to copy backup to %q: %w", destination, err))
+			continue
+		}
+		defer releaseDestination()
+		copiedDirPaths = append(copiedDirPaths, destination)
+	}
+
+	// Delete old backups.
+	if ctx.Err() != nil {
+		e.panic(errors.New("Backup interrupted. Old backups will not be deleted."))
+	}
+	if len(backupErrs) > 0 {
+		if !config.PruneOnPartialSuccess || !onlySkippedPaths(backupErrs) {
+			e.panic(errors.New("Errors occurred. Old backups will not be deleted automatically."))
+		}
+		e.warn(fmt.Sprintf("Deleting old backups despite %d errors because they only affected individual files and pruneOnPartialSuccess is set.", len(backupErrs)))
+	}
+	// Only record successful backups so files missed due to errors are in the next incremental backup.
+	if config.Incremental && len(backupErrs) == 0 {
+		// Files left out for being modified too recently were modified before `t`, so the next backup must look back further to include them.
+		stateTime := t.Add(-time.Duration(config.ExcludeModifiedWithinSeconds) * time.Second)
+		for _, destination := range copiedDirPaths {
+			e.printIfErr(writeIncrementalState(destination, stateTime, !result.Incremental))
+		}
+		err = writeIncrementalState(dstDirPath, stateTime, !result.Incremental)
+		e.panicIfErr(err)
+	}
+	// Each destination is pruned on its own so one that can't be read doesn't stop the others.
+	for _, destination := range copiedDirPaths {
+		l.Printf("Deleting old backups from %q.", destination)
+		e.catch(func() {
+			pruneBackups(e, config, filepath.Join(destination, "backups"), t)
+		})
+	}
+	pruneBackups(e, config, backupsDirPath, t)
+
+	l.Print("Done.")
+}
+
+// Whether every error in `errs` only left a file or directory within a source out of the backup.
+// Other errors, like unreadable sources and failed uploads, mean the backup can't replace older ones.
+func onlySkippedPaths(errs []error) bool {
+	for _, err := range errs {
+		var skipped skippedPathError
+		if !errors.As(err, &skipped) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the zip compression method for files. Compression level 0 stores files without compression.
+func compressionMethod(config *Config) uint16 {
+	if config.CompressionLevel != nil && *config.CompressionLevel == flate.NoCompression {
+		return zip.Store
+	}
+	return zip.Deflate
+}
+
+// Removes characters that are not safe in file names from a timezone abbreviation.
+func zoneLabel(zone string) string {
+	return regexp.MustCompile("[^A-Za-z0-9+-]").ReplaceAllString(zone, "")
+}
+
+// Reads from `r` until `ctx` is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	err := c.ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Counts bytes written to `w`.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,36 @@
+package backup
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Appended to the name of an archive backup to name the file of its volumes' SHA-256 checksums.
+// It isn't matched by the backup name patterns so it is never mistaken for a backup.
+const checksumSuffix = ".sha256"
+
+// Writes the hex encoded SHA-256 `sums` of `volumePaths` to `path` in the format of `sha256sum`, so `sha256sum -c` can check copies of the backup.
+func writeChecksums(path string, volumePaths, sums []string) error {
+	var b strings.Builder
+	for i, volumePath := range volumePaths {
+		// " *" marks the file as binary so sha256sum doesn't translate line endings on Windows.
+		fmt.Fprintf(&b, "%s *%s\n", sums[i], filepath.Base(volumePath))
+	}
+	return ioutil.WriteFile(path, []byte(b.String()), 0666)
+}
+
+// Returns an error if `sha256Hex` is set and isn't the sum in `hash` of the file at `filePath` as it was uploaded.
+func checkUploadSHA256(filePath string, hash hash.Hash, sha256Hex string) error {
+	if sha256Hex == "" {
+		return nil
+	}
+	uploaded := hex.EncodeToString(hash.Sum(nil))
+	if uploaded != sha256Hex {
+		return fmt.Errorf("%q changed after it was written. Its SHA-256 was %s but %s was uploaded, so the upload was abandoned.", filepath.Base(filePath), sha256Hex, uploaded)
+	}
+	return nil
+}
@@ -0,0 +1,436 @@
+package backup
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type Source struct {
+	Path                 string
+	Blacklist            []string
+	Whitelist            []string
+	FollowSymlinks       *bool // Back up the targets of symlinks rather than the links. nil to follow them.
+	MaxFileBytes         int64 // Overrides the config's `MaxFileBytes` if not 0.
+	ExcludeOlderThanDays int   // Overrides the config's `ExcludeOlderThanDays` if not 0.
+}
+
+// Whether symlinks within the source are followed. They were always followed before `FollowSymlinks` was added so it defaults to true.
+func (s Source) followSymlinks() bool {
+	return s.FollowSymlinks == nil || *s.FollowSymlinks
+}
+
+type Contact struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// Job is a named set of sources backed up to its own subdirectory of the destination directory.
+type Job struct {
+	Name           string
+	Sources        []Source
+	RetentionCount int    // Defaults to the config's `RetentionCount`.
+	Subdirectory   string // Defaults to `Name`.
+}
+
+// Retention is a grandfather-father-son retention policy.
+// The newest backup in each of the most recent `Daily` days, `Weekly` weeks and `Monthly` months is kept.
+type Retention struct {
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+// Whether the policy is configured. `RetentionCount` is used otherwise.
+func (r Retention) enabled() bool {
+	return r.Daily != 0 || r.Weekly != 0 || r.Monthly != 0
+}
+
+// Config configures a backup. It is usually read from `config.json` in the destination directory by `LoadConfig`.
+type Config struct {
+	// Directory containing the `backups` directory. Not read from JSON.
+	DestinationDir string `json:"-"`
+	// Receives progress and errors. Nothing is logged if nil. Not read from JSON.
+	Logger *log.Logger `json:"-"`
+	// Also receives errors, but nothing else. Optional. Not read from JSON.
+	ErrorLogger *log.Logger `json:"-"`
+	// Log file that `Logger` writes to. The part after `LogOffset` is attached to failure reports if `AttachLog` is set. Optional. Not read from JSON.
+	LogPath   string `json:"-"`
+	LogOffset int64  `json:"-"`
+	// Don't log progress while backing up. Not read from JSON.
+	Quiet bool `json:"-"`
+	// Log every file added and every path skipped. Not read from JSON.
+	Verbose bool `json:"-"`
+	// Name of the job this config is for. Empty without jobs. Not read from JSON.
+	JobName string `json:"-"`
+	// "source-<number>-<base name>" of the only source of configs split up by `SeparateArchives`. Added to the label in backup names. Not read from JSON.
+	SourceName string `json:"-"`
+
+	Name                   string
+	SendGridEnable         bool
+	SendGridAPIKey         string
+	SendGridFromAddress    string
+	SendGridEndpoint       string // Overrides the SendGrid mail send URL. Optional.
+	SalesScribeAPIKey      string
+	SalesScribeEnable      bool
+	SalesScribeEndpoint    string // Overrides the SalesScribe API URL. Optional.
+	ErrorContacts          []Contact
+	CCContacts             []Contact // Copied on report emails. Only used when there are `ErrorContacts`.
+	BCCContacts            []Contact // Blind copied on report emails. Only used when there are `ErrorContacts`.
+	ReportReplyTo          string    // Reply-to address of report emails. Optional.
+	Sources                []Source
+	Jobs                   []Job
+	Destinations           []string // Absolute paths of extra destination directories that every backup is copied to once it is written.
+	SeparateArchives       bool     // Back up each source to its own archive in its own subdirectory so sources can be restored and pruned independently.
+	RetentionCount         int
+	Retention              Retention
+	MaxAgeDays             int
+	MaxTotalBytes          int64
+	MinIntervalHours       int  // Skip the backup if the newest backup was taken less than this many hours ago. 0 to always back up.
+	PruneOnPartialSuccess  bool // Delete old backups when the only errors were files or directories within sources that were left out.
+	ReportTimeoutSeconds   int
+	ReportMaxRetries       int
+	ReportMaxErrorsInBody  int
+	ReportProxyURL         string // Proxy for report requests, overriding the HTTP_PROXY and HTTPS_PROXY environment variables. Optional.
+	ReportCAFile           string // PEM file of certificates trusted by report requests as well as the system's, e.g. of a TLS-intercepting proxy. Optional.
+	NotifyOnSuccess        bool
+	AttachLog              bool
+	AttachLogMaxBytes      int64
+	LogMaxBytes            int64
+	LogMaxFiles            int
+	LogFormat              string // "text" or "json". Only used by the executable, which configures `Logger`.
+	MetricsFilePath        string // Prometheus text file written after each backup. Optional.
+	SkipLockedFiles        bool
+	MaxFileBytes           int64 // 0 for no limit.
+	ExcludeOlderThanDays   int   // Skip files last modified more than this many days before the backup. 0 for no limit.
+	FailOnMissingSource    bool
+	MaxErrors              int // Stop the backup once there are more errors than this. 0 for no limit.
+	FileReadRetries        int // Times to retry opening or reading a file or directory after an error. 0 to not retry.
+	FreeSpaceSafetyFactor  float64
+	MinFreeBytes           int64
+	Concurrency            int
+	NamePrefix             string // Label included in backup names instead of the hostname.
+	NameTemplate           string // text/template for backup names. See `nameData` for the values available.
+	Timezone               string
+	SplitBytes             int64 // Maximum size of each volume. 0 to not split backups.
+	CompressionLevel       *int  // nil for the default level.
+	NoCompression          bool  // Store files without compression. The same as a `CompressionLevel` of 0.
+	CompressionThreads     int   // Goroutines compressing each file, or the tar.gz stream. 0 or 1 to compress in one goroutine.
+	EncryptionPassword     string
+	EncryptionPasswordEnv  string // Name of an environment variable containing the encryption password.
+	BackupFormat           string // "zip" or "directory". Directory backups hard link files unchanged since the previous one.
+	ArchiveFormat          string // "zip" or "targz". Only used when `BackupFormat` isn't "directory".
+	WriteIndex             bool   // Write "<backup name>.index.txt" listing the path and size of every file next to each backup.
+	SortEntries            bool   // Add each source's entries sorted by path so identical sources give archives with the same entry order. See `sortByEntryName`.
+	UseVSS                 bool
+	IncludeEmptyDirs       bool
+	BackupIgnoreFiles      bool
+	CaseSensitiveMatch     bool // Match blacklists, whitelists and ignore files case sensitively. They are case insensitive by default like Windows file systems.
+	Incremental            bool
+	FullBackupIntervalDays int
+	S3Enable               bool
+	S3Endpoint             string
+	S3Region               string
+	S3Bucket               string
+	S3AccessKey            string
+	S3SecretKey            string
+	S3Prefix               string
+	B2Enable               bool
+	B2KeyID                string
+	B2ApplicationKey       string
+	B2Bucket               string
+	B2Prefix               string
+	SFTPEnable             bool
+	SFTPHost               string
+	SFTPPort               int
+	SFTPUsername           string
+	SFTPPassword           string
+	SFTPKeyPath            string
+	SFTPKnownHostsPath     string
+	SFTPRemoteDir          string
+	SMTPEnable             bool
+	SMTPHost               string
+	SMTPPort               int
+	SMTPUsername           string
+	SMTPPassword           string
+	SMTPFromAddress        string
+	SESEnable              bool
+	SESRegion              string
+	SESAccessKey           string // Optional. The AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables are used when empty.
+	SESSecretKey           string
+	SESFromAddress         string
+	SESEndpoint            string // Overrides the SES API URL, which defaults to that of `SESRegion`. Optional.
+	MailgunEnable          bool
+	MailgunDomain          string
+	MailgunAPIKey          string
+	MailgunFromAddress     string
+	MailgunEndpoint        string // Overrides the Mailgun API base URL, e.g. for the EU region. Optional.
+	WebhookEnable          bool
+	WebhookURL             string
+	SlackEnable            bool
+	SlackWebhookURL        string
+	TeamsEnable            bool
+	TeamsWebhookURL        string
+	TelegramEnable         bool
+	TelegramBotToken       string
+	TelegramChatID         string
+	DiscordEnable          bool
+	DiscordWebhookURL      string
+
+	UploadMaxBytesPerSecond      int64 // Limits the speed of uploads to S3, B2 and SFTP. 0 for no limit.
+	ExcludeModifiedWithinSeconds int   // Skip files modified less than this many seconds before they are reached, as they may still be being written. 0 to back up every file.
+}
+
+// LoadConfig reads `config.json` from `dstDirPath`, sets `DestinationDir` to `dstDirPath` and validates it.
+// Defaults are applied by `Run` so fields that are not set can still be overridden before then.
+func LoadConfig(dstDirPath string) (Config, error) {
+	return LoadConfigFiles([]string{filepath.Join(dstDirPath, "config.json")}, dstDirPath)
+}
+
+// LoadConfigFiles is like `LoadConfig` but reads the config from `configPaths` so it can be kept outside the destination directory.
+// Several files are layered so shared settings can be kept in one of them. Each top level field in a file replaces the same field in earlier files.
+// Lists and objects are replaced as a whole, so an override listing `sources` replaces every source of the base config.
+func LoadConfigFiles(configPaths []string, dstDirPath string) (Config, error) {
+	config := Config{DestinationDir: dstDirPath}
+	// Merge fields by lower case name because fields are matched case insensitively.
+	merged := make(map[string]json.RawMessage)
+	for _, configPath := range configPaths {
+		configJSON, err := ioutil.ReadFile(configPath)
+		if err != nil {
+			return config, err
+		}
+		var fields map[string]json.RawMessage
+		err = json.Unmarshal(configJSON, &fields)
+		if err != nil {
+			return config, fmt.Errorf("Unable to parse %q: %w", configPath, err)
+		}
+		for name, value := range fields {
+			merged[strings.ToLower(name)] = value
+		}
+	}
+	mergedJSON, err := json.Marshal(merged)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(mergedJSON, &config)
+	if err != nil {
+		return config, err
+	}
+	err = config.resolveSecrets()
+	if err != nil {
+		return config, err
+	}
+	err = validate(&config)
+	return config, err
+}
+
+// Matches values that reference an environment variable, like "${ENV:SENDGRID_KEY}".
+var envReferenceRegexp = regexp.MustCompile(`^\$\{ENV:([^}]+)\}$`)
+
+// Replaces secret fields that reference an environment variable with its value so secrets don't have to be stored in `config.json`.
+func (config *Config) resolveSecrets() error {
+	secrets := []struct {
+		name  string
+		value *string
+	}{
+		{"sendGridAPIKey", &config.SendGridAPIKey},
+		{"salesScribeAPIKey", &config.SalesScribeAPIKey},
+		{"encryptionPassword", &config.EncryptionPassword},
+		{"s3AccessKey", &config.S3AccessKey},
+		{"s3SecretKey", &config.S3SecretKey},
+		{"b2KeyID", &config.B2KeyID},
+		{"b2ApplicationKey", &config.B2ApplicationKey},
+		{"sftpPassword", &config.SFTPPassword},
+		{"smtpPassword", &config.SMTPPassword},
+		{"sesAccessKey", &config.SESAccessKey},
+		{"sesSecretKey", &config.SESSecretKey},
+		{"mailgunAPIKey", &config.MailgunAPIKey},
+		{"webhookURL", &config.WebhookURL},
+		{"slackWebhookURL", &config.SlackWebhookURL},
+		{"teamsWebhookURL", &config.TeamsWebhookURL},
+		{"telegramBotToken", &config.TelegramBotToken},
+		{"discordWebhookURL", &config.DiscordWebhookURL},
+		{"reportProxyURL", &config.ReportProxyURL},
+	}
+	for _, secret := range secrets {
+		match := envReferenceRegexp.FindStringSubmatch(*secret.value)
+		if match == nil {
+			continue
+		}
+		value, ok := os.LookupEnv(match[1])
+		if !ok {
+			return fmt.Errorf("Environment variable %q referenced by %s is not set.", match[1], secret.name)
+		}
+		*secret.value = value
+	}
+	return nil
+}
+
+// JobConfigs returns a config for each job, or only the job called `name` if it is not empty.
+// The config itself is returned when it has no jobs.
+// With `SeparateArchives`, there is a config for each source of each job instead.
+// With `Destinations`, each config's extra destinations are the same subdirectory of each destination, which its backup is copied to.
+func (config Config) JobConfigs(name string) ([]Config, error) {
+	jobConfigs, err := config.jobConfigs(name)
+	if err != nil {
+		return nil, err
+	}
+	if config.SeparateArchives {
+		jobConfigs = separateSourceConfigs(jobConfigs)
+	}
+	if len(config.Destinations) == 0 {
+		return jobConfigs, nil
+	}
+	for i, jobConfig := range jobConfigs {
+		// Jobs use the same subdirectory in every destination.
+		relPath, err := filepath.Rel(config.DestinationDir, jobConfig.DestinationDir)
+		if err != nil {
+			return nil, err
+		}
+		jobConfigs[i].Destinations = make([]string, len(config.Destinations))
+		for j, destination := range config.Destinations {
+			jobConfigs[i].Destinations[j] = filepath.Join(destination, relPath)
+		}
+	}
+	return jobConfigs, nil
+}
+
+func (config Config) jobConfigs(name string) ([]Config, error) {
+	if len(config.Jobs) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("Job %q does not exist. No jobs are configured.", name)
+		}
+		return []Config{config}, nil
+	}
+	if len(config.Sources) > 0 {
+		return nil, errors.New("Sources must be listed in jobs when jobs are configured.")
+	}
+
+	configs := make([]Config, 0)
+	names := make(map[string]bool)
+	for _, job := range config.Jobs {
+		if job.Name == "" {
+			return nil, errors.New("Every job must have a name.")
+		}
+		if names[job.Name] {
+			return nil, fmt.Errorf("There is more than one job called %q.", job.Name)
+		}
+		names[job.Name] = true
+		if name != "" && job.Name != name {
+			continue
+		}
+
+		jobConfig := config
+		jobConfig.Jobs = nil
+		jobConfig.Sources = job.Sources
+		if job.RetentionCount != 0 {
+			jobConfig.RetentionCount = job.RetentionCount
+		}
+		subdirectory := job.Subdirectory
+		if subdirectory == "" {
+			subdirectory = job.Name
+		}
+		jobConfig.DestinationDir = filepath.Join(config.DestinationDir, subdirectory)
+		// Keep the config name so reports say which machine the job is on.
+		jobConfig.Name = job.Name
+		jobConfig.JobName = job.Name
+		if config.Name != "" {
+			jobConfig.Name = config.Name + " - " + job.Name
+		}
+		configs = append(configs, jobConfig)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("Job %q does not exist.", name)
+	}
+	return configs, nil
+}
+
+// Returns a config for each source of each of `configs`, backed up to the subdirectory "source-<number>-<base name>" of the config's destination directory.
+// Each source has its own "backups" directory, lock, incremental state and retention, like a job.
+func separateSourceConfigs(configs []Config) []Config {
+	sourceConfigs := make([]Config, 0)
+	for _, config := range configs {
+		for i, source := range config.Sources {
+			sourceName := fmt.Sprintf("source-%d", i+1)
+			// Only characters allowed in labels are kept so the name can be added to the label.
+			baseName := regexp.MustCompile("[^A-Za-z0-9-]").ReplaceAllString(filepath.Base(source.Path), "")
+			if baseName != "" {
+				sourceName += "-" + baseName
+			}
+			sourceConfig := config
+			sourceConfig.Sources = []Source{source}
+			sourceConfig.SourceName = sourceName
+			sourceConfig.DestinationDir = filepath.Join(config.DestinationDir, sourceName)
+			sourceConfig.Name = config.Name + " - " + sourceName
+			if config.Name == "" {
+				sourceConfig.Name = sourceName
+			}
+			sourceConfigs = append(sourceConfigs, sourceConfig)
+		}
+	}
+	return sourceConfigs
+}
+
+// Returns `config.Logger`, or a logger that discards everything if it is nil.
+func (config *Config) logger() *log.Logger {
+	if config.Logger == nil {
+		return log.New(io.Discard, "", 0)
+	}
+	return config.Logger
+}
+
+// Returns the location of `config.Timezone`, which defaults to UTC.
+func (config *Config) location() (*time.Location, error) {
+	if config.Timezone == "" {
+		return time.UTC, nil
+	}
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid timezone %q: %w", config.Timezone, err)
+	}
+	return location, nil
+}
+
+// Checks `config` with `validate` and replaces unset fields with their defaults.
+// Defaults are applied even if `config` is invalid so reports can still be sent.
+func (config *Config) setDefaults() error {
+	err := validate(config)
+	if config.RetentionCount == 0 {
+		config.RetentionCount = 3
+	}
+	if config.ReportTimeoutSeconds == 0 {
+		config.ReportTimeoutSeconds = 30
+	}
+	if config.ReportMaxRetries == 0 {
+		config.ReportMaxRetries = 3
+	}
+	if config.AttachLogMaxBytes == 0 {
+		config.AttachLogMaxBytes = 1 << 20
+	}
+	if config.ReportMaxErrorsInBody == 0 {
+		config.ReportMaxErrorsInBody = 100
+	}
+	if config.Concurrency == 0 {
+		config.Concurrency = 1
+	}
+	if config.FreeSpaceSafetyFactor == 0 {
+		config.FreeSpaceSafetyFactor = 1
+	}
+	if config.FullBackupIntervalDays == 0 {
+		config.FullBackupIntervalDays = 7
+	}
+	if config.NoCompression {
+		level := flate.NoCompression
+		config.CompressionLevel = &level
+	}
+	return err
+}
@@ -0,0 +1,202 @@
+package backup
+
+import (
+	"compress/flate"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+// CheckConfig loads and validates the config in `dstDirPath`, resolving environment variable references, then logs a summary of it with secrets masked.
+// Nothing is backed up. Returns the first problem found, which lists every validation problem. `logger` may be nil.
+func CheckConfig(dstDirPath string, logger *log.Logger) error {
+	return CheckConfigFiles([]string{filepath.Join(dstDirPath, "config.json")}, dstDirPath, logger)
+}
+
+// CheckConfigFiles is like `CheckConfig` but reads the config from `configPaths`, layered like `LoadConfigFiles`.
+func CheckConfigFiles(configPaths []string, dstDirPath string, logger *log.Logger) error {
+	e := newErrorHandler(logger)
+	return e.catch(func() {
+		config, err := LoadConfigFiles(configPaths, dstDirPath)
+		e.panicIfErr(err)
+		configs, err := config.JobConfigs("")
+		e.panicIfErr(err)
+		for _, jobConfig := range configs {
+			e.panicIfErr(jobConfig.setDefaults())
+			e.logger.Print(jobConfig.summary())
+		}
+		e.logger.Print("Config is valid.")
+	})
+}
+
+// Describes what `config` backs up, how long backups are kept and where reports and uploads are sent. Secrets are masked.
+func (config *Config) summary() string {
+	var b strings.Builder
+	line := func(format string, a ...interface{}) {
+		fmt.Fprintf(&b, format+"\n", a...)
+	}
+
+	line("Name: %q", config.Name)
+	line("Destination: %s", config.DestinationDir)
+	line("Sources:")
+	for _, source := range config.Sources {
+		line("\t%s (%d blacklist patterns, %d whitelist patterns, followSymlinks %t, maxFileBytes %d, excludeOlderThanDays %d)", source.Path, len(source.Blacklist), len(source.Whitelist), source.followSymlinks(), source.MaxFileBytes, source.ExcludeOlderThanDays)
+	}
+
+	if config.BackupFormat == "directory" {
+		line("Format: directory, hard linking files unchanged since the previous backup.")
+	} else if config.ArchiveFormat == "targz" {
+		line("Format: tar.gz.")
+	}
+	if config.WriteIndex {
+		line("Index: written next to each backup.")
+	}
+	if config.SortEntries {
+		line("Entries: sorted by path.")
+	}
+	if config.CompressionLevel != nil && *config.CompressionLevel == flate.NoCompression {
+		line("Compression: none.")
+	} else if config.CompressionThreads > 1 {
+		line("Compression: %d threads.", config.CompressionThreads)
+	}
+	if config.Retention.enabled() {
+		line("Retention: newest backup of the last %d days, %d weeks and %d months.", config.Retention.Daily, config.Retention.Weekly, config.Retention.Monthly)
+	} else {
+		line("Retention: latest %d backups.", config.RetentionCount)
+	}
+	if config.MaxAgeDays > 0 {
+		line("\tDelete backups older than %d days.", config.MaxAgeDays)
+	}
+	if config.MaxTotalBytes > 0 {
+		line("\tDelete the oldest backups while they total more than %d bytes.", config.MaxTotalBytes)
+	}
+	if config.PruneOnPartialSuccess {
+		line("\tDelete old backups even when errors left individual files out.")
+	}
+	if config.MinIntervalHours > 0 {
+		line("Minimum interval: skip the backup if the newest is less than %d hours old.", config.MinIntervalHours)
+	}
+	if config.Incremental {
+		line("Incremental: full backup every %d days.", config.FullBackupIntervalDays)
+	}
+	if config.EncryptionPassword != "" {
+		line("Encryption: password %s", mask(config.EncryptionPassword))
+	} else if config.EncryptionPasswordEnv != "" {
+		line("Encryption: password from environment variable %q", config.EncryptionPasswordEnv)
+	}
+
+	line("Reports (notifyOnSuccess %t):", config.NotifyOnSuccess)
+	if config.SendGridEnable {
+		line("\tSendGrid: from %s, API key %s", config.SendGridFromAddress, mask(config.SendGridAPIKey))
+		if config.SendGridEndpoint != "" {
+			line("\t\tEndpoint: %s", config.SendGridEndpoint)
+		}
+	}
+	if config.SalesScribeEnable {
+		line("\tSalesScribe: API key %s", mask(config.SalesScribeAPIKey))
+		if config.SalesScribeEndpoint != "" {
+			line("\t\tEndpoint: %s", config.SalesScribeEndpoint)
+		}
+	}
+	if config.SMTPEnable {
+		port := config.SMTPPort
+		if port == 0 {
+			port = 587
+		}
+		line("\tSMTP: %s:%d from %s, username %q, password %s", config.SMTPHost, port, config.SMTPFromAddress, config.SMTPUsername, mask(config.SMTPPassword))
+	}
+	if config.SESEnable {
+		if config.SESAccessKey != "" {
+			line("\tSES: %s from %s, access key %s, secret key %s", config.SESRegion, config.SESFromAddress, mask(config.SESAccessKey), mask(config.SESSecretKey))
+		} else {
+			line("\tSES: %s from %s, credentials from the environment", config.SESRegion, config.SESFromAddress)
+		}
+		if config.SESEndpoint != "" {
+			line("\t\tEndpoint: %s", config.SESEndpoint)
+		}
+	}
+	if config.MailgunEnable {
+		line("\tMailgun: domain %s from %s, API key %s", config.MailgunDomain, config.MailgunFromAddress, mask(config.MailgunAPIKey))
+		if config.MailgunEndpoint != "" {
+			line("\t\tEndpoint: %s", config.MailgunEndpoint)
+		}
+	}
+	if config.WebhookEnable {
+		line("\tWebhook: %s", mask(config.WebhookURL))
+	}
+	if config.SlackEnable {
+		line("\tSlack: %s", mask(config.SlackWebhookURL))
+	}
+	if config.TeamsEnable {
+		line("\tTeams: %s", mask(config.TeamsWebhookURL))
+	}
+	if config.TelegramEnable {
+		line("\tTelegram: chat %q, bot token %s", config.TelegramChatID, mask(config.TelegramBotToken))
+	}
+	if config.DiscordEnable {
+		line("\tDiscord: %s", mask(config.DiscordWebhookURL))
+	}
+	if config.ReportProxyURL != "" {
+		line("\tProxy: %s", redactURL(config.ReportProxyURL))
+	}
+	if config.ReportCAFile != "" {
+		line("\tCA file: %s", config.ReportCAFile)
+	}
+	for _, contact := range config.ErrorContacts {
+		line("\tContact: %s <%s>", contact.Name, contact.Email)
+	}
+	if config.ReportReplyTo != "" {
+		line("\tReply to: %s", config.ReportReplyTo)
+	}
+	for _, contact := range config.CCContacts {
+		line("\tCC: %s <%s>", contact.Name, contact.Email)
+	}
+	for _, contact := range config.BCCContacts {
+		line("\tBCC: %s <%s>", contact.Name, contact.Email)
+	}
+
+	if config.MetricsFilePath != "" {
+		line("Metrics: %s", config.MetricsFilePath)
+	}
+
+	line("Uploads:")
+	if config.UploadMaxBytesPerSecond > 0 {
+		line("\tLimited to %d bytes per second.", config.UploadMaxBytesPerSecond)
+	}
+	if config.S3Enable {
+		line("\tS3: bucket %q in %s, prefix %q, endpoint %q, access key %s, secret key %s", config.S3Bucket, config.S3Region, config.S3Prefix, config.S3Endpoint, mask(config.S3AccessKey), mask(config.S3SecretKey))
+	}
+	if config.B2Enable {
+		line("\tB2: bucket %q, prefix %q, key ID %s, application key %s", config.B2Bucket, config.B2Prefix, mask(config.B2KeyID), mask(config.B2ApplicationKey))
+	}
+	if config.SFTPEnable {
+		port := config.SFTPPort
+		if port == 0 {
+			port = 22
+		}
+		line("\tSFTP: %s@%s:%d into %q, key %q, password %s, known_hosts %q", config.SFTPUsername, config.SFTPHost, port, config.SFTPRemoteDir, config.SFTPKeyPath, mask(config.SFTPPassword), config.SFTPKnownHostsPath)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Hides the password of `rawURL`, or all of it if it can't be parsed.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return mask(rawURL)
+	}
+	return u.Redacted()
+}
+
+// Hides all but the last 4 characters of `secret`, or all of it if it is short.
+func mask(secret string) string {
+	if secret == "" {
+		return "(not set)"
+	}
+	if len(secret) < 12 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
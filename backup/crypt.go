@@ -0,0 +1,286 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Encrypted backups are zips wrapped in the following container:
+//   - The 8 byte magic string "WFBENC1\n".
+//   - A 16 byte random salt.
+//   - PBKDF2-SHA256 iterations as a big endian uint32. The salt and password derive a 32 byte AES-256 key.
+//   - Chunk size as a big endian uint32.
+//   - The zip in chunks, each encrypted with AES-256-GCM. Each chunk's nonce is its index as a big endian uint64 followed by 4 zero bytes.
+//     The additional data is a single byte that is 1 for the final chunk and 0 otherwise, so truncation is detected.
+//     Every chunk except the final one contains exactly chunk size bytes of plaintext.
+const (
+	encryptionMagic      = "WFBENC1\n"
+	encryptionSaltSize   = 16
+	encryptionIterations = 600000
+	encryptionChunkSize  = 64 << 10
+	// The header isn't authenticated, so its values are limited before they are used to allocate chunks or derive the key.
+	encryptionMaxChunkSize  = 16 << 20
+	encryptionMinIterations = 1000
+	encryptionMaxIterations = 10000000
+)
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	buffer []byte
+	index  uint64
+}
+
+// Returns a writer that encrypts everything written to it with `password` and writes it to `w`.
+// Close must be called to write the final chunk. It does not close `w`.
+func newEncryptWriter(w io.Writer, password string) (io.WriteCloser, error) {
+	salt := make([]byte, encryptionSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newEncryptionAEAD(password, salt, encryptionIterations)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, len(encryptionMagic)+encryptionSaltSize+8)
+	header = append(header, encryptionMagic...)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, encryptionIterations)
+	header = binary.BigEndian.AppendUint32(header, encryptionChunkSize)
+	_, err = w.Write(header)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{
+		w:      w,
+		aead:   aead,
+		buffer: make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// Only write a full chunk once more data arrives so the final chunk is always written by Close.
+		if len(e.buffer) == encryptionChunkSize {
+			err := e.writeChunk(false)
+			if err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buffer[len(e.buffer):encryptionChunkSize], p)
+		e.buffer = e.buffer[:len(e.buffer)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.writeChunk(true)
+}
+
+func (e *encryptWriter) writeChunk(final bool) error {
+	ciphertext := e.aead.Seal(nil, encryptionNonce(e.index), e.buffer, encryptionAdditionalData(final))
+	_, err := e.w.Write(ciphertext)
+	if err != nil {
+		return err
+	}
+	e.index++
+	e.buffer = e.buffer[:0]
+	return nil
+}
+
+type decryptReader struct {
+	r         *bufio.Reader
+	aead      cipher.AEAD
+	chunkSize int
+	index     uint64
+	plaintext []byte
+	done      bool
+}
+
+// Returns a reader that decrypts `r`, which must start with the container header.
+func newDecryptReader(r io.Reader, password string) (io.Reader, error) {
+	header := make([]byte, len(encryptionMagic)+encryptionSaltSize+8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("Not an encrypted backup.")
+	}
+	salt := header[len(encryptionMagic) : len(encryptionMagic)+encryptionSaltSize]
+	iterations := binary.BigEndian.Uint32(header[len(encryptionMagic)+encryptionSaltSize:])
+	chunkSize := binary.BigEndian.Uint32(header[len(encryptionMagic)+encryptionSaltSize+4:])
+	if chunkSize == 0 || chunkSize > encryptionMaxChunkSize || iterations < encryptionMinIterations || iterations > encryptionMaxIterations {
+		return nil, errors.New("Not an encrypted backup or unsupported format.")
+	}
+	aead, err := newEncryptionAEAD(password, salt, int(iterations))
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:         bufio.NewReader(r),
+		aead:      aead,
+		chunkSize: int(chunkSize),
+	}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.plaintext) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		err := d.readChunk()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.plaintext)
+	d.plaintext = d.plaintext[n:]
+	return n, nil
+}
+
+func (d *decryptReader) readChunk() error {
+	ciphertext := make([]byte, d.chunkSize+d.aead.Overhead())
+	n, err := io.ReadFull(d.r, ciphertext)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			return errors.New("Encrypted backup is truncated.")
+		}
+		return err
+	}
+	// The final chunk is the last in the file.
+	final := err == io.ErrUnexpectedEOF
+	if !final {
+		_, err := d.r.Peek(1)
+		final = err == io.EOF
+	}
+	plaintext, err := d.aead.Open(nil, encryptionNonce(d.index), ciphertext[:n], encryptionAdditionalData(final))
+	if err != nil {
+		return errors.New("The password is wrong or the backup is corrupt.")
+	}
+	d.plaintext = plaintext
+	d.index++
+	d.done = final
+	return nil
+}
+
+func newEncryptionAEAD(password string, salt []byte, iterations int) (cipher.AEAD, error) {
+	if password == "" {
+		return nil, errors.New("Encryption password is empty.")
+	}
+	key := pbkdf2(sha256.New, []byte(password), salt, iterations, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptionNonce(index uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce, index)
+	return nonce
+}
+
+func encryptionAdditionalData(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Derives a key from a password as described in RFC 8018.
+func pbkdf2(h func() hash.Hash, password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(h, password)
+	key := make([]byte, 0, keyLen)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write(binary.BigEndian.AppendUint32(nil, block))
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+// Opens a backup, decrypting it to a temporary file next to it first if it is encrypted.
+// The temporary file is only readable by its owner and is kept out of the shared temporary directory, where other users could find the plaintext.
+// Backups are read as tar.gz if their names say so, and as zips otherwise.
+// The returned function closes the backup and removes any temporary file.
+func openBackup(backupPath, password string) (*archive, func(), error) {
+	tarGz := tarGzNameReg.MatchString(backupPath)
+	file, err := openVolumes(backupPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	magic := make([]byte, len(encryptionMagic))
+	_, err = file.ReadAt(magic, 0)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if !bytes.Equal(magic, []byte(encryptionMagic)) {
+		a, err := newArchive(file, file.size, tarGz)
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		return a, func() { file.Close() }, nil
+	}
+
+	// Zips need random access and tar.gz backups are read more than once so decrypt to a temporary file.
+	defer file.Close()
+	if password == "" {
+		return nil, nil, errors.New("Backup is encrypted. Provide the password with --password or the BACKUP_PASSWORD environment variable.")
+	}
+	decrypted, err := newDecryptReader(io.NewSectionReader(file, 0, file.size), password)
+	if err != nil {
+		return nil, nil, err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(backupPath), ".backup-decrypted-*.tmp")
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to create temporary file to decrypt backup to: %w", err)
+	}
+	closeTemp := func() {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+	}
+	size, err := io.Copy(tempFile, decrypted)
+	if err != nil {
+		closeTemp()
+		return nil, nil, fmt.Errorf("Unable to decrypt backup: %w", err)
+	}
+	a, err := newArchive(tempFile, size, tarGz)
+	if err != nil {
+		closeTemp()
+		return nil, nil, err
+	}
+	return a, closeTemp, nil
+}
@@ -0,0 +1,68 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// Returns `plaintext` encrypted with `password`.
+func encryptTest(t *testing.T, plaintext []byte, password string) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := newEncryptWriter(&b, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	plaintext := bytes.Repeat([]byte("backup"), encryptionChunkSize/2)
+	r, err := newDecryptReader(bytes.NewReader(encryptTest(t, plaintext, "password")), "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("Decrypted %d bytes that differ from the %d encrypted.", len(got), len(plaintext))
+	}
+}
+
+func TestDecryptRejectsHeader(t *testing.T) {
+	encrypted := encryptTest(t, []byte("backup"), "password")
+	iterationsOffset := len(encryptionMagic) + encryptionSaltSize
+	tests := []struct {
+		name       string
+		iterations uint32
+		chunkSize  uint32
+	}{
+		{"zero chunk size", encryptionIterations, 0},
+		{"huge chunk size", encryptionIterations, 1<<32 - 1},
+		{"zero iterations", 0, encryptionChunkSize},
+		{"huge iterations", 1<<32 - 1, encryptionChunkSize},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			corrupt := append([]byte{}, encrypted...)
+			binary.BigEndian.PutUint32(corrupt[iterationsOffset:], test.iterations)
+			binary.BigEndian.PutUint32(corrupt[iterationsOffset+4:], test.chunkSize)
+			_, err := newDecryptReader(bytes.NewReader(corrupt), "password")
+			if err == nil || err.Error() != "Not an encrypted backup or unsupported format." {
+				t.Fatalf("Got %v, want the header rejected.", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Copies the finished backup at `paths` to the "backups" directory of the extra destination `dstDirPath`.
+// `paths` are the volumes, or the directory of a directory backup, followed by the index and checksum files if they were written.
+// Everything is copied to "<name>.partial" and only renamed once every file is copied so a failed copy is never mistaken for a good backup.
+// The destination is locked until the returned function is called so it can be pruned without another run racing on it.
+func copyToDestination(ctx context.Context, e *errorHandler, config *Config, dstDirPath string, paths []string, m manifest) (func(), error) {
+	err := os.MkdirAll(dstDirPath, os.ModeDir|os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	releaseLock, err := acquireLock(dstDirPath)
+	if err != nil {
+		return nil, err
+	}
+	backupsDirPath := filepath.Join(dstDirPath, "backups")
+	err = os.Mkdir(backupsDirPath, os.ModeDir|os.ModePerm)
+	if err != nil && !os.IsExist(err) {
+		releaseLock()
+		return nil, err
+	}
+
+	dstPaths := make([]string, 0, len(paths))
+	removePartials := func() {
+		for _, dstPath := range dstPaths {
+			os.RemoveAll(dstPath + ".partial")
+		}
+	}
+	for _, path := range paths {
+		dstPath := filepath.Join(backupsDirPath, filepath.Base(path))
+		dstPaths = append(dstPaths, dstPath)
+		info, err := os.Stat(path)
+		if err == nil {
+			if info.IsDir() {
+				err = copyDirBackup(ctx, e, config, path, backupsDirPath, dstPath, m)
+			} else {
+				err = copyFile(ctx, path, dstPath+".partial")
+			}
+		}
+		if err != nil {
+			removePartials()
+			releaseLock()
+			return nil, err
+		}
+	}
+	for _, dstPath := range dstPaths {
+		err := os.Rename(dstPath+".partial", dstPath)
+		if err != nil {
+			removePartials()
+			releaseLock()
+			return nil, err
+		}
+	}
+	return releaseLock, nil
+}
+
+// Copies the directory backup at `srcPath` to `<dstPath>.partial`, hard linking files that are unchanged since the newest directory backup in `backupsDirPath` like `snapshot.add` does.
+// `m` is the manifest of the backup being copied.
+func copyDirBackup(ctx context.Context, e *errorHandler, config *Config, srcPath, backupsDirPath, dstPath string, m manifest) error {
+	s, err := newSnapshot(e, config, backupsDirPath, dstPath)
+	if err != nil {
+		return err
+	}
+	// The backed up files by their paths within the backup directory.
+	files := make(map[string]manifestFile, len(m.Files))
+	for _, f := range m.Files {
+		files[snapshotFilePath("", f.Path)] = f
+	}
+	return filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcPath, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(s.path+".partial", relPath)
+		if info.IsDir() {
+			return os.MkdirAll(dst, os.ModeDir|os.ModePerm)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dst)
+		}
+		f, ok := files[relPath]
+		previousFile, previousOK := s.previousFiles[f.Path]
+		if ok && previousOK && previousFile.Size == f.Size && previousFile.SHA256 == f.SHA256 {
+			err := os.Link(snapshotFilePath(s.previousPath, f.Path), dst)
+			if err == nil {
+				return nil
+			}
+		}
+		err = copyFile(ctx, path, dst)
+		if err != nil {
+			return err
+		}
+		// Later backups are only linked to files with the same modification time.
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	})
+}
+
+// Copies the file at `srcPath` to a new file at `dstPath`.
+func copyFile(ctx context.Context, srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, &contextReader{ctx: ctx, r: src})
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,157 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the names in the "backups" directory of `dstDirPath`.
+func backupsDirNames(t *testing.T, dstDirPath string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(dstDirPath, "backups"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestDestinations(t *testing.T) {
+	srcPath := filepath.Join(t.TempDir(), "src")
+	err := os.Mkdir(srcPath, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(srcPath, "a.txt"), []byte("a"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"", "directory"} {
+		t.Run("format "+format, func(t *testing.T) {
+			config := Config{
+				Sources:        []Source{{Path: srcPath}},
+				DestinationDir: t.TempDir(),
+				Destinations:   []string{t.TempDir(), filepath.Join(t.TempDir(), "missing")},
+				NamePrefix:     "test",
+				RetentionCount: 1,
+				WriteIndex:     true,
+				BackupFormat:   format,
+			}
+			// An older backup in each destination is deleted by retention.
+			old, err := backupName(&config, time.Now().Add(-time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, destination := range config.Destinations {
+				err := os.MkdirAll(filepath.Join(destination, "backups"), os.ModePerm)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(filepath.Join(destination, "backups", old+".zip"), nil, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := Run(context.Background(), config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(result.Errors) > 0 {
+				t.Fatal(result.Errors)
+			}
+			want := backupsDirNames(t, config.DestinationDir)
+			for _, destination := range config.Destinations {
+				got := backupsDirNames(t, destination)
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("%q contains %q, want %q.", destination, got, want)
+				}
+				if format == "directory" {
+					content, err := os.ReadFile(snapshotFilePath(filepath.Join(destination, "backups", want[0]), "source-1:-src/a.txt"))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if string(content) != "a" {
+						t.Fatalf("Copied a.txt as %q.", content)
+					}
+					continue
+				}
+				for _, name := range want {
+					original, err := os.ReadFile(filepath.Join(config.DestinationDir, "backups", name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					copied, err := os.ReadFile(filepath.Join(destination, "backups", name))
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !bytes.Equal(copied, original) {
+						t.Fatalf("Copy of %q in %q differs.", name, destination)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDestinationFailure(t *testing.T) {
+	srcPath := t.TempDir()
+	// A file can't be used as a destination directory.
+	filePath := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(filePath, nil, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		Sources:        []Source{{Path: srcPath}},
+		DestinationDir: t.TempDir(),
+		Destinations:   []string{filePath, t.TempDir()},
+	}
+	result, err := Run(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) != 1 || !strings.Contains(result.Errors[0].Error(), filePath) {
+		t.Fatalf("Got errors %v, want one about %q.", result.Errors, filePath)
+	}
+	got := backupsDirNames(t, config.Destinations[1])
+	want := backupsDirNames(t, config.DestinationDir)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("The destination after the one that failed contains %q, want %q.", got, want)
+	}
+}
+
+func TestJobConfigsDestinations(t *testing.T) {
+	dstDirPath := filepath.FromSlash("/backups")
+	destination := filepath.FromSlash("/nas/backups")
+	config := Config{
+		Name:           "office",
+		DestinationDir: dstDirPath,
+		Destinations:   []string{destination},
+		Jobs:           []Job{{Name: "documents", Sources: []Source{{Path: "/documents"}}}},
+	}
+	configs, err := config.JobConfigs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(configs) != 1 {
+		t.Fatalf("Got %d configs, want 1.", len(configs))
+	}
+	if configs[0].Name != "office - documents" {
+		t.Fatalf("Name is %q, want %q.", configs[0].Name, "office - documents")
+	}
+	want := []string{filepath.Join(destination, "documents")}
+	if !reflect.DeepEqual(configs[0].Destinations, want) {
+		t.Fatalf("Destinations are %q, want %q.", configs[0].Destinations, want)
+	}
+}
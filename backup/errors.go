@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"io"
+	"log"
+	"sync"
+)
+
+type errorHandler struct {
+	logger    *log.Logger
+	errLogger *log.Logger // Also receives errors if not nil.
+	mu        sync.Mutex  // Guards `errs` and `warnings` because sources are backed up concurrently.
+	errs      []error
+	warnings  []string
+}
+
+// Creates an error handler that logs to `logger`, or nowhere if it is nil.
+func newErrorHandler(logger *log.Logger) *errorHandler {
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	return &errorHandler{logger: logger}
+}
+
+// Carries an error from `errorHandler.panic` to `errorHandler.catch`.
+type fatalError struct {
+	err error
+}
+
+func (e *errorHandler) print(err error) {
+	e.record(2, err)
+}
+
+// Records and logs `err` then stops the current operation. Must be called within `catch`.
+func (e *errorHandler) panic(err error) {
+	e.record(2, err)
+	panic(fatalError{err: err})
+}
+
+// Logs a problem that does not count as an error.
+// Warnings do not prevent old backups being deleted and are not reported.
+func (e *errorHandler) warn(message string) {
+	e.mu.Lock()
+	e.warnings = append(e.warnings, message)
+	e.mu.Unlock()
+	withLevel(e.logger, "warning").Output(2, "Warning: "+message)
+}
+
+func (e *errorHandler) printIfErr(err error) {
+	if err != nil {
+		e.record(2, err)
+	}
+}
+
+func (e *errorHandler) panicIfErr(err error) {
+	if err != nil {
+		e.record(2, err)
+		panic(fatalError{err: err})
+	}
+}
+
+// Records and logs `err`. `calldepth` is the number of frames above `record` of the code the error is attributed to in logs, like `log.Logger.Output`'s.
+func (e *errorHandler) record(calldepth int, err error) {
+	e.mu.Lock()
+	e.errs = append(e.errs, err)
+	e.mu.Unlock()
+	withLevel(e.logger, "error").Output(calldepth+1, err.Error())
+	if e.errLogger != nil {
+		withLevel(e.errLogger, "error").Output(calldepth+1, err.Error())
+	}
+}
+
+// Runs `f` and returns the error passed to `e.panic`, if any, so fatal errors don't crash callers of the package.
+func (e *errorHandler) catch(f func()) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		fatal, ok := r.(fatalError)
+		if !ok {
+			panic(r)
+		}
+		err = fatal.err
+	}()
+	f()
+	return nil
+}
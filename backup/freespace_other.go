@@ -0,0 +1,15 @@
+//go:build !windows
+
+package backup
+
+import "syscall"
+
+// Returns the bytes available to the current user on the volume containing `dirPath`.
+func freeSpace(dirPath string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dirPath, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
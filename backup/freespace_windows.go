@@ -0,0 +1,24 @@
+//go:build windows
+
+package backup
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// Returns the bytes available to the current user on the volume containing `dirPath`.
+func freeSpace(dirPath string) (int64, error) {
+	dirPathPtr, err := syscall.UTF16PtrFromString(dirPath)
+	if err != nil {
+		return 0, err
+	}
+	var freeBytes uint64
+	r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(dirPathPtr)), uintptr(unsafe.Pointer(&freeBytes)), 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return int64(freeBytes), nil
+}
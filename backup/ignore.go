@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Name of the files listing paths not to back up when `config.BackupIgnoreFiles` is set.
+// They use gitignore syntax and apply to the directory containing them and everything within it.
+const ignoreFileName = ".backupignore"
+
+type ignoreRule struct {
+	line     int
+	negated  bool // Re-includes paths excluded by earlier rules.
+	dirOnly  bool
+	anchored bool     // Matches the path relative to the ignore file's directory. Other rules match the base name at any depth.
+	elems    []string // A single element unless anchored.
+}
+
+type ignoreFile struct {
+	path    string
+	dirPath string
+	rules   []ignoreRule
+}
+
+// Reads the ignore file in `dirPath`, lower casing its patterns if `foldCase` is set. Returns nil if there isn't one.
+func readIgnoreFile(dirPath string, foldCase bool) (*ignoreFile, error) {
+	filePath := filepath.Join(dirPath, ignoreFileName)
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	f := &ignoreFile{path: filePath, dirPath: dirPath}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if foldCase {
+			line = strings.ToLower(line)
+		}
+		rule, ok := parseIgnoreRule(line)
+		if !ok {
+			continue
+		}
+		for _, elem := range rule.elems {
+			_, err := path.Match(elem, "")
+			if err != nil {
+				return nil, fmt.Errorf("Invalid pattern on line %d of %q: %w", lineNumber, filePath, err)
+			}
+		}
+		rule.line = lineNumber
+		f.rules = append(f.rules, rule)
+	}
+	return f, scanner.Err()
+}
+
+// Parses a line of an ignore file. Returns false for blank lines and comments.
+func parseIgnoreRule(line string) (ignoreRule, bool) {
+	var rule ignoreRule
+	line = strings.TrimSuffix(line, "\r")
+	// Trailing spaces are ignored unless escaped.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negated = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+	// A separator at the start or in the middle anchors the pattern to the ignore file's directory.
+	rule.anchored = strings.Contains(line, "/")
+	rule.elems = strings.Split(strings.TrimPrefix(line, "/"), "/")
+	return rule, true
+}
+
+// Returns the ignore file and line that exclude `srcPath`, or an empty string if it isn't excluded.
+// Later rules take precedence, and rules in deeper directories take precedence over those in their parents.
+func (w *walker) ignoredBy(srcPath string, isDir bool) (string, error) {
+	var ignoredBy string
+	for _, f := range w.ignores {
+		relPath, err := filepath.Rel(f.dirPath, srcPath)
+		if err != nil {
+			return "", err
+		}
+		relElems := strings.Split(w.fold(filepath.ToSlash(relPath)), "/")
+		for _, rule := range f.rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+			var match bool
+			if rule.anchored {
+				match, err = matchElems(rule.elems, relElems)
+			} else {
+				match, err = path.Match(rule.elems[0], relElems[len(relElems)-1])
+			}
+			if err != nil {
+				return "", err
+			}
+			if !match {
+				continue
+			}
+			ignoredBy = ""
+			if !rule.negated {
+				ignoredBy = fmt.Sprintf("%s line %d", f.path, rule.line)
+			}
+		}
+	}
+	return ignoredBy, nil
+}
@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Name of the file in the destination directory that records when the last backups were taken.
+const incrementalStateName = "incremental.json"
+
+type incrementalState struct {
+	// Start of the last successful backup. Files modified after this are in the next incremental backup.
+	LastBackup time.Time `json:"lastBackup"`
+	// Start of the last successful full backup.
+	LastFullBackup time.Time `json:"lastFullBackup"`
+}
+
+// Returns the time that files must be modified after to be included in this backup, or the zero time for a full backup.
+// Full backups are taken when there is no state or the last full backup is older than `config.FullBackupIntervalDays`.
+func incrementalSince(config *Config, dstDirPath string, now time.Time) (time.Time, error) {
+	if !config.Incremental {
+		return time.Time{}, nil
+	}
+	state, err := readIncrementalState(dstDirPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if state.LastFullBackup.IsZero() || now.Sub(state.LastFullBackup) >= time.Duration(config.FullBackupIntervalDays)*24*time.Hour {
+		return time.Time{}, nil
+	}
+	return state.LastBackup, nil
+}
+
+func readIncrementalState(dstDirPath string) (incrementalState, error) {
+	var state incrementalState
+	stateJSON, err := ioutil.ReadFile(filepath.Join(dstDirPath, incrementalStateName))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(stateJSON, &state)
+	return state, err
+}
+
+// Records a successful backup that started at `start`. `full` is false for incremental backups.
+func writeIncrementalState(dstDirPath string, start time.Time, full bool) error {
+	state, err := readIncrementalState(dstDirPath)
+	if err != nil {
+		return err
+	}
+	state.LastBackup = start
+	if full {
+		state.LastFullBackup = start
+	}
+	stateJSON, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Write then rename so an interrupted write doesn't lose the state.
+	statePath := filepath.Join(dstDirPath, incrementalStateName)
+	err = ioutil.WriteFile(statePath+".partial", stateJSON, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(statePath+".partial", statePath)
+}
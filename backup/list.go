@@ -0,0 +1,54 @@
+package backup
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// List logs a table of this machine's backups in `config.DestinationDir`, newest first, with their sizes and ages, then their total size.
+// Only backups that retention would consider are listed. Returns every error that occurred. `logger` may be nil.
+func List(config Config, logger *log.Logger) []error {
+	e := newErrorHandler(logger)
+	e.catch(func() {
+		list(e, &config, time.Now())
+	})
+	return e.errs
+}
+
+func list(e *errorHandler, config *Config, now time.Time) {
+	location, err := config.location()
+	e.panicIfErr(err)
+	backupsDirPath := filepath.Join(config.DestinationDir, "backups")
+	backups, err := findBackups(e, config, backupsDirPath)
+	e.panicIfErr(err)
+
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Name\tDate\tBytes\tAge")
+	var totalBytes int64
+	for i := len(backups) - 1; i >= 0; i-- {
+		backup := backups[i]
+		t := time.Unix(backup.unix, 0).In(location)
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", backup.name, t.Format("2006-01-02 15:04:05 MST"), backup.size, formatAge(now.Sub(t)))
+		totalBytes += backup.size
+	}
+	tw.Flush()
+	e.logger.Print(b.String() + fmt.Sprintf("%d backups totalling %d bytes in %q.", len(backups), totalBytes, backupsDirPath))
+}
+
+// Formats `d` in days and hours, or minutes if it is less than an hour.
+func formatAge(d time.Duration) string {
+	if d < time.Hour {
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	}
+	days := int(d.Hours()) / 24
+	hours := int(d.Hours()) % 24
+	if days == 0 {
+		return fmt.Sprintf("%dh", hours)
+	}
+	return fmt.Sprintf("%dd %dh", days, hours)
+}
@@ -0,0 +1,52 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Prevents overlapping runs using `backup.lock` in the destination directory.
+// Returns a function that releases the lock.
+func acquireLock(dstDirPath string) (func(), error) {
+	lockPath := filepath.Join(dstDirPath, "backup.lock")
+	release := func() {
+		os.Remove(lockPath)
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		lockFile, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = lockFile.WriteString(strconv.Itoa(os.Getpid()))
+			closeErr := lockFile.Close()
+			if err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				release()
+				return nil, err
+			}
+			return release, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		// Remove the lock if the process holding it has died.
+		pidBytes, err := ioutil.ReadFile(lockPath)
+		if err != nil {
+			return nil, err
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+		if err == nil && processRunning(pid) {
+			return nil, fmt.Errorf("Another backup (PID %d) is already running in %q. Delete %q if this is wrong.", pid, dstDirPath, lockPath)
+		}
+		err = os.Remove(lockPath)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("Unable to acquire %q.", lockPath)
+}
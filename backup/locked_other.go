@@ -0,0 +1,13 @@
+//go:build !windows
+
+package backup
+
+import (
+	"errors"
+	"os"
+)
+
+// Reports whether `err` is due to a file being in use or inaccessible.
+func isLocked(err error) bool {
+	return errors.Is(err, os.ErrPermission)
+}
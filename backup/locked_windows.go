@@ -0,0 +1,20 @@
+//go:build windows
+
+package backup
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Windows error codes returned when another process has a file open.
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// Reports whether `err` is due to a file being in use or inaccessible.
+func isLocked(err error) bool {
+	return errors.Is(err, os.ErrPermission) || errors.Is(err, errorSharingViolation) || errors.Is(err, errorLockViolation)
+}
@@ -0,0 +1,66 @@
+package backup
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// JSONLogWriter converts lines written by a `log.Logger` to JSON objects, one per line.
+// Objects have `time`, `level`, `message` and `file` fields.
+// Use it with only the `log.Lshortfile` flag so the time isn't duplicated and the file can be parsed.
+type JSONLogWriter struct {
+	w     io.Writer
+	level string
+}
+
+// NewJSONLogWriter returns a writer that writes JSON to `w`. Lines are logged at the info level unless they are errors or warnings logged by this package.
+func NewJSONLogWriter(w io.Writer) *JSONLogWriter {
+	return &JSONLogWriter{w: w, level: "info"}
+}
+
+type jsonLogEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"`
+}
+
+func (j *JSONLogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSuffix(string(p), "\n")
+	entry := jsonLogEntry{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Level:   j.level,
+		Message: line,
+	}
+	// `log.Lshortfile` starts lines with "file.go:123: ".
+	file, message, ok := strings.Cut(line, ": ")
+	if ok && strings.Contains(file, ".go:") {
+		entry.File = file
+		entry.Message = message
+	}
+	if j.level == "warning" {
+		// The level already says so.
+		entry.Message = strings.TrimPrefix(entry.Message, "Warning: ")
+	}
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	_, err = j.w.Write(append(entryJSON, '\n'))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Returns a copy of `logger` that logs at `level` if it writes JSON, or `logger` itself otherwise.
+func withLevel(logger *log.Logger, level string) *log.Logger {
+	j, ok := logger.Writer().(*JSONLogWriter)
+	if !ok {
+		return logger
+	}
+	return log.New(&JSONLogWriter{w: j.w, level: level}, logger.Prefix(), logger.Flags())
+}
@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Name of the zip entry listing every backed up file.
+const manifestName = "manifest.json"
+
+// Appended to the name of a backup to name its index, which isn't matched by the backup name patterns so it is never mistaken for a backup.
+const indexSuffix = ".index.txt"
+
+type manifest struct {
+	Timestamp time.Time      `json:"timestamp"`
+	Since     *time.Time     `json:"since,omitempty"` // nil for full backups. Incremental backups contain files modified after this.
+	Files     []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Adds the manifest to the zip. Must be called after all files have been added.
+func writeManifest(w *zip.Writer, m manifest) error {
+	manifestJSON, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	dst, err := w.CreateHeader(&zip.FileHeader{
+		Name:     manifestName,
+		Method:   zip.Deflate,
+		Modified: m.Timestamp,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(manifestJSON)
+	return err
+}
+
+// Writes the path and size of every file in `m` to `path`, one per line separated by a tab, so backups can be searched without opening them.
+func writeIndex(path string, m manifest) error {
+	var b strings.Builder
+	for _, f := range m.Files {
+		fmt.Fprintf(&b, "%s\t%d\n", f.Path, f.Size)
+	}
+	return ioutil.WriteFile(path, []byte(b.String()), 0666)
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A blacklist or whitelist pattern, split up once per source rather than for every path.
+type pattern struct {
+	raw string // As configured.
+	// Patterns without a separator match the base name. Patterns with one are split into elements that match the path relative to the source.
+	name    string
+	elems   []string
+	dirOnly bool // Patterns ending in a separator only match directories.
+}
+
+// Prepares `raw` patterns for matching, lower casing them if `foldCase` is set. Patterns must already have been checked by `checkPattern`.
+func compilePatterns(raw []string, foldCase bool) []pattern {
+	patterns := make([]pattern, len(raw))
+	for i, p := range raw {
+		patterns[i].raw = p
+		p = filepath.ToSlash(p)
+		if foldCase {
+			p = strings.ToLower(p)
+		}
+		if strings.HasSuffix(p, "/") {
+			patterns[i].dirOnly = true
+			p = strings.TrimRight(p, "/")
+		}
+		if strings.Contains(p, "/") {
+			patterns[i].elems = strings.Split(strings.Trim(p, "/"), "/")
+		} else {
+			patterns[i].name = p
+		}
+	}
+	return patterns
+}
+
+// Returns an error if `raw` is malformed, so it is found before backing up rather than when the first path is matched.
+func checkPattern(raw string) error {
+	for _, elem := range strings.Split(filepath.ToSlash(raw), "/") {
+		_, err := path.Match(elem, "")
+		if err != nil {
+			return fmt.Errorf("Invalid pattern %q: %w", raw, err)
+		}
+	}
+	return nil
+}
+
+// Returns the first of `patterns` that matches `srcPath`, a path within the walker's source, or nil if none do.
+// Patterns without a separator match the base name, as they always have.
+// Patterns with a separator match the path relative to the source, where a `**` element matches any number of directories.
+// Directory only patterns are skipped unless `isDir` is set.
+func (w *walker) firstMatch(patterns []pattern, srcPath string, isDir bool) (*pattern, error) {
+	baseName := w.fold(filepath.Base(srcPath))
+	var relElems []string // Only split up if a pattern needs it.
+	for i := range patterns {
+		p := &patterns[i]
+		if p.dirOnly && !isDir {
+			continue
+		}
+		if p.elems == nil {
+			match, err := filepath.Match(p.name, baseName)
+			if err != nil {
+				return nil, err
+			}
+			if match {
+				return p, nil
+			}
+			continue
+		}
+		if relElems == nil {
+			relPath, err := filepath.Rel(w.source.Path, srcPath)
+			if err != nil {
+				return nil, err
+			}
+			if relPath == "." {
+				// The source itself only matches base name patterns.
+				relElems = []string{}
+			} else {
+				relElems = strings.Split(w.fold(filepath.ToSlash(relPath)), "/")
+			}
+		}
+		if len(relElems) == 0 {
+			continue
+		}
+		match, err := matchElems(p.elems, relElems)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+// Lower cases `s` unless `config.CaseSensitiveMatch` is set, because Windows file systems are case insensitive.
+func (w *walker) fold(s string) string {
+	if w.config.CaseSensitiveMatch {
+		return s
+	}
+	return strings.ToLower(s)
+}
+
+func matchElems(pattern, elems []string) (bool, error) {
+	if len(pattern) == 0 {
+		return len(elems) == 0, nil
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(elems); i++ {
+			match, err := matchElems(pattern[1:], elems[i:])
+			if err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	}
+	if len(elems) == 0 {
+		return false, nil
+	}
+	match, err := path.Match(pattern[0], elems[0])
+	if err != nil || !match {
+		return false, err
+	}
+	return matchElems(pattern[1:], elems[1:])
+}
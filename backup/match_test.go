@@ -0,0 +1,108 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Source that matching tests pretend paths are within. Matching never reads the file system.
+var testSourcePath = filepath.FromSlash("/src")
+
+func newTestWalker(caseSensitive bool, patterns ...string) *walker {
+	return newWalker(nil, newErrorHandler(nil), &Config{CaseSensitiveMatch: caseSensitive}, Source{Path: testSourcePath, Blacklist: patterns})
+}
+
+var matchTests = []struct {
+	pattern       string
+	path          string // Relative to `testSourcePath`, with forward slashes.
+	isDir         bool
+	caseSensitive bool
+	want          bool
+}{
+	// Case insensitive by default, like Windows file systems.
+	{"*.TMP", "a.tmp", false, false, true},
+	{"*.tmp", "A.TMP", false, false, true},
+	{"*.TMP", "a.tmp", false, true, false},
+	{"*.tmp", "a.tmp", false, true, true},
+	{"Node_Modules/", "node_modules", true, false, true},
+	{"Node_Modules/", "node_modules", true, true, false},
+	{"Docs/**/*.Bak", "docs/x/y/file.BAK", false, false, true},
+	{"Docs/**/*.Bak", "docs/x/y/file.BAK", false, true, false},
+	{"Docs/**/*.Bak", "Docs/x/y/file.Bak", false, true, true},
+	// Patterns ending in a separator only match directories, at any depth unless they contain another separator.
+	{"node_modules/", "node_modules", true, false, true},
+	{"node_modules/", "a/b/node_modules", true, false, true},
+	{"node_modules/", "a/b/node_modules", false, false, false},
+	{"node_modules/", "node_modules", false, false, false},
+	{"a/node_modules/", "a/node_modules", true, false, true},
+	{"a/node_modules/", "b/a/node_modules", true, false, false},
+	{"a/node_modules/", "a/node_modules", false, false, false},
+}
+
+func TestFirstMatch(t *testing.T) {
+	for _, test := range matchTests {
+		w := newTestWalker(test.caseSensitive, test.pattern)
+		srcPath := filepath.Join(testSourcePath, filepath.FromSlash(test.path))
+		match, err := w.firstMatch(w.blacklist, srcPath, test.isDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (match != nil) != test.want {
+			t.Errorf("Pattern %q matching %q (directory %t, case sensitive %t) is %t, want %t.", test.pattern, test.path, test.isDir, test.caseSensitive, match != nil, test.want)
+		}
+	}
+}
+
+func TestIgnoreFileCase(t *testing.T) {
+	dirPath := t.TempDir()
+	err := os.WriteFile(filepath.Join(dirPath, ignoreFileName), []byte("*.LOG\n!Keep.log\n"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		caseSensitive bool
+		want          bool // Ignored.
+	}{
+		{"a.log", false, true},
+		{"A.Log", false, true},
+		{"keep.LOG", false, false},
+		{"a.log", true, false},
+		{"a.LOG", true, true},
+		{"Keep.log", true, false},
+	}
+	for _, test := range tests {
+		f, err := readIgnoreFile(dirPath, !test.caseSensitive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := newWalker(nil, newErrorHandler(nil), &Config{CaseSensitiveMatch: test.caseSensitive}, Source{Path: dirPath})
+		w.ignores = []*ignoreFile{f}
+		ignoredBy, err := w.ignoredBy(filepath.Join(dirPath, test.name), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (ignoredBy != "") != test.want {
+			t.Errorf("%q (case sensitive %t) ignored is %t, want %t.", test.name, test.caseSensitive, ignoredBy != "", test.want)
+		}
+	}
+}
+
+// Compares matching with patterns compiled once per source, as the walker does, to compiling them for every path.
+func BenchmarkFirstMatch(b *testing.B) {
+	patterns := []string{"*.tmp", "*.bak", "Thumbs.db", "node_modules/", ".git/", "AppData/**/Cache", "Downloads/**/*.iso", "**/obj/**"}
+	srcPath := filepath.Join(testSourcePath, filepath.FromSlash("Users/Example/Documents/Projects/site/src/components/Header.tsx"))
+	b.Run("precompiled", func(b *testing.B) {
+		w := newTestWalker(false, patterns...)
+		for i := 0; i < b.N; i++ {
+			w.firstMatch(w.blacklist, srcPath, false)
+		}
+	})
+	b.Run("compiled per path", func(b *testing.B) {
+		w := newTestWalker(false)
+		for i := 0; i < b.N; i++ {
+			w.firstMatch(compilePatterns(patterns, true), srcPath, false)
+		}
+	})
+}
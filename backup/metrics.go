@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metrics written to `config.MetricsFilePath`, in the order they are written.
+var metricHelp = []struct{ name, help string }{
+	{"backup_last_success_timestamp", "Unix time the last backup without errors finished. 0 if there hasn't been one."},
+	{"backup_duration_seconds", "Duration of the last backup."},
+	{"backup_size_bytes", "Size of the last backup's archive, or of the files copied for directory backups."},
+	{"backup_file_count", "Files in the last backup."},
+	{"backup_error_count", "Errors during the last backup."},
+}
+
+// Writes the metrics of `result` to `config.MetricsFilePath` in the Prometheus text format, keeping those of other jobs and destinations.
+// The file is replaced by renaming a temporary file so collectors never read half of it.
+func writeMetrics(config *Config, result Result, finished time.Time) error {
+	// Values by metric name, then by labels.
+	values := make(map[string]map[string]string)
+	for _, metric := range metricHelp {
+		values[metric.name] = make(map[string]string)
+	}
+	err := readMetrics(config.MetricsFilePath, values)
+	if err != nil {
+		return fmt.Errorf("Unable to read metrics file: %w", err)
+	}
+
+	labels := fmt.Sprintf("job_name=%s,destination=%s", quoteLabel(config.JobName), quoteLabel(config.DestinationDir))
+	if len(result.Errors) == 0 {
+		values["backup_last_success_timestamp"][labels] = fmt.Sprint(finished.Unix())
+	} else if values["backup_last_success_timestamp"][labels] == "" {
+		values["backup_last_success_timestamp"][labels] = "0"
+	}
+	values["backup_duration_seconds"][labels] = fmt.Sprint(result.Duration.Seconds())
+	values["backup_size_bytes"][labels] = fmt.Sprint(result.CompressedByteCount)
+	values["backup_file_count"][labels] = fmt.Sprint(result.FileCount)
+	values["backup_error_count"][labels] = fmt.Sprint(len(result.Errors))
+
+	var b strings.Builder
+	for _, metric := range metricHelp {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", metric.name, metric.help, metric.name)
+		labelSets := make([]string, 0)
+		for labelSet := range values[metric.name] {
+			labelSets = append(labelSets, labelSet)
+		}
+		sort.Strings(labelSets)
+		for _, labelSet := range labelSets {
+			fmt.Fprintf(&b, "%s{%s} %s\n", metric.name, labelSet, values[metric.name][labelSet])
+		}
+	}
+
+	// The temporary file doesn't end in ".prom" so collectors ignore it.
+	tempFile, err := ioutil.TempFile(filepath.Dir(config.MetricsFilePath), ".backup-metrics-*.tmp")
+	if err != nil {
+		return fmt.Errorf("Unable to write metrics file: %w", err)
+	}
+	defer os.Remove(tempFile.Name())
+	_, err = tempFile.WriteString(b.String())
+	if err != nil {
+		tempFile.Close()
+		return fmt.Errorf("Unable to write metrics file: %w", err)
+	}
+	err = tempFile.Close()
+	if err != nil {
+		return fmt.Errorf("Unable to write metrics file: %w", err)
+	}
+	// Temporary files are only readable by their owner, which the collector may not be.
+	err = os.Chmod(tempFile.Name(), 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to write metrics file: %w", err)
+	}
+	err = os.Rename(tempFile.Name(), config.MetricsFilePath)
+	if err != nil {
+		return fmt.Errorf("Unable to write metrics file: %w", err)
+	}
+	return nil
+}
+
+// Adds the values of the known metrics in the metrics file at `path` to `values`. A missing file has no values.
+func readMetrics(path string, values map[string]map[string]string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// Lines are "<name>{<labels>} <value>".
+		open := strings.Index(line, "{")
+		close := strings.LastIndex(line, "} ")
+		if open < 0 || close < open {
+			continue
+		}
+		metricValues, ok := values[line[:open]]
+		if !ok {
+			continue
+		}
+		metricValues[line[open+1:close]] = line[close+2:]
+	}
+	return scanner.Err()
+}
+
+// Quotes a label value, escaping backslashes, quotes and line feeds as Prometheus requires.
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,164 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// The default `config.NameTemplate`. The label is omitted if it is empty.
+const defaultNameTemplate = "{{.Unix}}_{{with .Label}}{{.}}_{{end}}{{.Zone}}-{{.Date}}"
+
+// Values available to `config.NameTemplate`.
+type nameData struct {
+	Unix     string // Used for sorting so names must start with it.
+	Date     string // YYYY-MM-DD.
+	Time     string // HHMMSS.
+	Zone     string // Timezone abbreviation.
+	Hostname string
+	Label    string // `config.NamePrefix` or the hostname, with only letters, digits and hyphens.
+	JobName  string // Empty without jobs.
+}
+
+// Placeholders rendered in place of the values that change between backups so names can be matched by `backupNameRegs`.
+const (
+	unixPlaceholder = "\x00unix\x00"
+	datePlaceholder = "\x00date\x00"
+	timePlaceholder = "\x00time\x00"
+	zonePlaceholder = "\x00zone\x00"
+)
+
+// Matches the names of backups from before templates and labels were added. Old backups may have unpadded months and days.
+const legacyNamePattern = "(\\d+)_[A-Za-z0-9+-]+-\\d{4}-\\d{1,2}-\\d{1,2}"
+
+// Characters that aren't allowed in Windows file names.
+var invalidNameReg = regexp.MustCompile("[<>:\"/\\\\|?*\\x00-\\x1f]")
+
+func parseNameTemplate(config *Config) (*template.Template, error) {
+	text := config.NameTemplate
+	if text == "" {
+		text = defaultNameTemplate
+	}
+	tmpl, err := template.New("nameTemplate").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nameTemplate: %w", err)
+	}
+	return tmpl, nil
+}
+
+// Returns the data for `config.NameTemplate` with the values that change between backups set to placeholders.
+func newNameData(config *Config) (nameData, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nameData{}, fmt.Errorf("Unable to get hostname for backup name: %w", err)
+	}
+	label := config.NamePrefix
+	if label == "" {
+		label = hostname
+	}
+	// Backups of separate sources are told apart by their names too, e.g. when uploaded to the same bucket.
+	if config.SourceName != "" {
+		label += "-" + config.SourceName
+	}
+	return nameData{
+		Unix:     unixPlaceholder,
+		Date:     datePlaceholder,
+		Time:     timePlaceholder,
+		Zone:     zonePlaceholder,
+		Hostname: hostname,
+		Label:    regexp.MustCompile("[^A-Za-z0-9-]").ReplaceAllString(label, ""),
+		JobName:  config.JobName,
+	}, nil
+}
+
+// Renders `config.NameTemplate` with placeholders and checks it starts with the unix timestamp so backups sort by age.
+func renderNameTemplate(config *Config) (string, error) {
+	tmpl, err := parseNameTemplate(config)
+	if err != nil {
+		return "", err
+	}
+	data, err := newNameData(config)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	err = tmpl.Execute(&b, data)
+	if err != nil {
+		return "", fmt.Errorf("Invalid nameTemplate: %w", err)
+	}
+	name := b.String()
+	if !strings.HasPrefix(name, unixPlaceholder) {
+		return "", errors.New("Invalid nameTemplate. Names must start with {{.Unix}} so backups can be sorted by age.")
+	}
+	// Anything that could be read as part of the timestamp must be separated from it.
+	rest := strings.TrimPrefix(name, unixPlaceholder)
+	if rest != "" && (rest[0] == '\x00' || (rest[0] >= '0' && rest[0] <= '9')) {
+		return "", errors.New("Invalid nameTemplate. {{.Unix}} must be followed by a separator like \"_\".")
+	}
+	return name, nil
+}
+
+// Returns the name of a backup created at `t`, without the kind or extension.
+func backupName(config *Config, t time.Time) (string, error) {
+	name, err := renderNameTemplate(config)
+	if err != nil {
+		return "", err
+	}
+	zone, _ := t.Zone()
+	name = strings.NewReplacer(
+		unixPlaceholder, strconv.FormatInt(t.Unix(), 10),
+		datePlaceholder, fmt.Sprintf("%d-%02d-%02d", t.Year(), t.Month(), t.Day()),
+		timePlaceholder, fmt.Sprintf("%02d%02d%02d", t.Hour(), t.Minute(), t.Second()),
+		zonePlaceholder, zoneLabel(zone),
+	).Replace(name)
+	if invalidNameReg.MatchString(name) || strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return "", fmt.Errorf("Invalid backup name %q from nameTemplate. Names must be valid Windows file names.", name)
+	}
+	return name, nil
+}
+
+// Returns expressions matching the names of this machine's backups followed by `suffixPattern`, capturing the unix timestamp.
+// Backups from before templates and labels were added are also matched so they are still deleted by retention.
+func backupNameRegs(config *Config, suffixPattern string) ([]*regexp.Regexp, error) {
+	name, err := renderNameTemplate(config)
+	if err != nil {
+		return nil, err
+	}
+	pattern := strings.NewReplacer(
+		unixPlaceholder, "(\\d+)",
+		datePlaceholder, "\\d{4}-\\d{1,2}-\\d{1,2}",
+		timePlaceholder, "\\d{6}",
+		zonePlaceholder, "[A-Za-z0-9+-]+",
+	).Replace(regexp.QuoteMeta(name))
+	regs := make([]*regexp.Regexp, 0)
+	for _, p := range []string{pattern, legacyNamePattern} {
+		reg, err := regexp.Compile("^" + p + suffixPattern + "$")
+		if err != nil {
+			return nil, err
+		}
+		regs = append(regs, reg)
+	}
+	return regs, nil
+}
+
+// Returns the unix timestamp in `name` if it matches one of `regs`.
+func matchBackupName(regs []*regexp.Regexp, name string) (int64, bool) {
+	for _, reg := range regs {
+		match := reg.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		unix, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		return unix, true
+	}
+	return 0, false
+}
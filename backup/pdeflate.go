@@ -0,0 +1,229 @@
+package backup
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Size of the pieces of input compressed in parallel by `parallelDeflateWriter`.
+const parallelDeflateChunkBytes = 1 << 20
+
+// Size of Deflate's window. Each chunk is compressed with this much of the end of the previous chunk as its dictionary.
+const deflateWindowBytes = 32 << 10
+
+// Chunk buffers, reused because a writer is created for every file and most files are smaller than a chunk.
+var deflateChunkPool = sync.Pool{New: func() interface{} {
+	chunk := make([]byte, 0, parallelDeflateChunkBytes)
+	return &chunk
+}}
+
+// Compresses to a raw Deflate stream using several goroutines, like pigz.
+// Input is split into chunks that are compressed concurrently, each ending with a sync flush so the compressed chunks can be concatenated into one stream.
+// Priming each chunk with the end of the previous one means the output is barely larger than compressing in one goroutine.
+// Input that fits in one chunk is compressed by `Close` without starting a goroutine.
+type parallelDeflateWriter struct {
+	w       io.Writer
+	level   int
+	threads int
+	chunk   *[]byte // Input not yet being compressed. From `deflateChunkPool`, or nil until written to.
+	dict    []byte  // Copy of the end of the previous chunk.
+	// Chunks being compressed, in order. At most `threads` are compressed at once.
+	pending []chan deflateResult
+	err     error
+}
+
+type deflateResult struct {
+	compressed []byte
+	err        error
+}
+
+// Returns a Deflate writer to `w` that uses `threads` goroutines if `threads` is more than 1.
+func newDeflateWriter(w io.Writer, level, threads int) (io.WriteCloser, error) {
+	if threads <= 1 {
+		return flate.NewWriter(w, level)
+	}
+	// Check the level now rather than in every goroutine.
+	_, err := flate.NewWriter(ioutil.Discard, level)
+	if err != nil {
+		return nil, err
+	}
+	return &parallelDeflateWriter{w: w, level: level, threads: threads}, nil
+}
+
+func (w *parallelDeflateWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if w.chunk == nil {
+			w.chunk = deflateChunkPool.Get().(*[]byte)
+		}
+		space := parallelDeflateChunkBytes - len(*w.chunk)
+		if space > len(p) {
+			space = len(p)
+		}
+		*w.chunk = append(*w.chunk, p[:space]...)
+		p = p[space:]
+		if len(*w.chunk) == parallelDeflateChunkBytes {
+			w.compress(false)
+			if w.err != nil {
+				return 0, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Compresses the remaining input, ending the stream, and waits for every chunk to be written. Doesn't close the underlying writer.
+func (w *parallelDeflateWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.dict == nil && len(w.pending) == 0 {
+		// Nothing has been compressed yet so there is no point in another goroutine.
+		var chunk []byte
+		if w.chunk != nil {
+			chunk = *w.chunk
+		}
+		compressed, err := deflateChunk(chunk, nil, w.level, true)
+		w.releaseChunk()
+		if err != nil {
+			return err
+		}
+		_, err = w.w.Write(compressed)
+		return err
+	}
+	w.compress(true)
+	return w.err
+}
+
+// Returns the chunk buffer to the pool.
+func (w *parallelDeflateWriter) releaseChunk() {
+	if w.chunk != nil {
+		*w.chunk = (*w.chunk)[:0]
+		deflateChunkPool.Put(w.chunk)
+		w.chunk = nil
+	}
+}
+
+// Starts compressing `w.chunk` then writes finished chunks until few enough are pending, or all of them if `last` is set.
+func (w *parallelDeflateWriter) compress(last bool) {
+	chunkBuffer, dict := w.chunk, w.dict
+	w.chunk = nil
+	var chunk []byte
+	if chunkBuffer != nil {
+		chunk = *chunkBuffer
+	}
+	// Only the last chunk can be shorter than the window, and nothing follows it.
+	// The dictionary is copied so the chunk can go back to the pool once it is compressed.
+	if len(chunk) >= deflateWindowBytes {
+		w.dict = append([]byte(nil), chunk[len(chunk)-deflateWindowBytes:]...)
+	}
+
+	result := make(chan deflateResult, 1)
+	w.pending = append(w.pending, result)
+	go func() {
+		compressed, err := deflateChunk(chunk, dict, w.level, last)
+		if chunkBuffer != nil {
+			*chunkBuffer = (*chunkBuffer)[:0]
+			deflateChunkPool.Put(chunkBuffer)
+		}
+		result <- deflateResult{compressed, err}
+	}()
+
+	for len(w.pending) > 0 && (last || len(w.pending) >= w.threads) {
+		r := <-w.pending[0]
+		w.pending = w.pending[1:]
+		if w.err != nil {
+			continue
+		}
+		w.err = r.err
+		if w.err == nil {
+			_, w.err = w.w.Write(r.compressed)
+		}
+	}
+}
+
+// Compresses `chunk` as part of a Deflate stream that `dict` came before. Only the last chunk ends the stream.
+func deflateChunk(chunk, dict []byte, level int, last bool) ([]byte, error) {
+	var b bytes.Buffer
+	fw, err := flate.NewWriterDict(&b, level, dict)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fw.Write(chunk)
+	if err != nil {
+		return nil, err
+	}
+	if last {
+		err = fw.Close()
+	} else {
+		// Ends the chunk on a byte boundary without ending the stream.
+		err = fw.Flush()
+	}
+	return b.Bytes(), err
+}
+
+// Writes a gzip stream compressed by a `parallelDeflateWriter`.
+type parallelGzipWriter struct {
+	w           io.Writer
+	deflate     io.WriteCloser
+	crc         hash.Hash32
+	size        uint32 // Modulo 2^32 as gzip requires.
+	wroteHeader bool
+}
+
+// Returns a gzip writer to `w` that compresses with `threads` goroutines.
+// Like `gzip.Writer`'s by default, the header has no name or modification time.
+func newParallelGzipWriter(w io.Writer, level, threads int) (*parallelGzipWriter, error) {
+	deflate, err := newDeflateWriter(w, level, threads)
+	if err != nil {
+		return nil, err
+	}
+	return &parallelGzipWriter{w: w, deflate: deflate, crc: crc32.NewIEEE()}, nil
+}
+
+func (g *parallelGzipWriter) writeHeader() error {
+	if g.wroteHeader {
+		return nil
+	}
+	g.wroteHeader = true
+	// Magic number, Deflate, no flags, no modification time, no extra flags, unknown OS.
+	_, err := g.w.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255})
+	return err
+}
+
+func (g *parallelGzipWriter) Write(p []byte) (int, error) {
+	err := g.writeHeader()
+	if err != nil {
+		return 0, err
+	}
+	n, err := g.deflate.Write(p)
+	g.crc.Write(p[:n])
+	g.size += uint32(n)
+	return n, err
+}
+
+// Ends the gzip stream. Doesn't close the underlying writer.
+func (g *parallelGzipWriter) Close() error {
+	err := g.writeHeader()
+	if err != nil {
+		return err
+	}
+	err = g.deflate.Close()
+	if err != nil {
+		return err
+	}
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer, g.crc.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:], g.size)
+	_, err = g.w.Write(trailer)
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package backup
+
+import "syscall"
+
+// Reports whether a process with `pid` is running.
+func processRunning(pid int) bool {
+	// Signal 0 checks the process exists without affecting it.
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,20 @@
+//go:build windows
+
+package backup
+
+import "syscall"
+
+// Reports whether a process with `pid` is running.
+func processRunning(pid int) bool {
+	const processQueryLimitedInformation = 0x1000
+	const stillActive = 259
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		// Access is denied for processes owned by other users, which are running.
+		return err == syscall.ERROR_ACCESS_DENIED
+	}
+	defer syscall.CloseHandle(handle)
+	var exitCode uint32
+	err = syscall.GetExitCodeProcess(handle, &exitCode)
+	return err == nil && exitCode == stillActive
+}
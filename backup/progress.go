@@ -0,0 +1,79 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// How often progress is logged while backing up.
+const progressInterval = 10 * time.Second
+
+// Tracks how much of a backup has been written so it can be logged while backing up.
+// The totals are estimates from counting the sources before backing up.
+type progress struct {
+	totalFiles int
+	totalBytes int64
+	files      atomic.Int64
+	bytes      atomic.Int64
+	start      time.Time
+}
+
+func newProgress(totalFiles int, totalBytes int64) *progress {
+	return &progress{totalFiles: totalFiles, totalBytes: totalBytes, start: time.Now()}
+}
+
+// Logs progress every `progressInterval` until the returned function is called.
+func (p *progress) logPeriodically(logger *log.Logger) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				logger.Print(p.String())
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// Describes how much has been backed up and roughly how long the rest will take.
+func (p *progress) String() string {
+	files := p.files.Load()
+	bytes := p.bytes.Load()
+	s := fmt.Sprintf("Progress: %d of %d files, %d of %d bytes", files, p.totalFiles, bytes, p.totalBytes)
+	if p.totalBytes == 0 || bytes == 0 {
+		return s + "."
+	}
+	// Sources may have changed since they were counted.
+	if bytes > p.totalBytes {
+		return s + " (100%)."
+	}
+	// Assume the rest is backed up at the same rate so far.
+	elapsed := time.Since(p.start)
+	remaining := time.Duration(float64(elapsed) * float64(p.totalBytes-bytes) / float64(bytes))
+	return fmt.Sprintf("%s (%.0f%%), about %s remaining.", s, float64(bytes)/float64(p.totalBytes)*100, remaining.Round(time.Second))
+}
+
+// Counts bytes read from `r` towards `p`.
+type progressReader struct {
+	p *progress
+	r io.Reader
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.p.bytes.Add(int64(n))
+	return n, err
+}
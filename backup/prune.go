@@ -0,0 +1,227 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// A backup in the backups directory.
+type backupFile struct {
+	name    string   // Without the volume number of split backups.
+	unix    int64    // Creation time parsed from the name.
+	size    int64    // Total of every volume. For directory backups, the total of every file including those linked to other backups.
+	volumes []string // Names of the files that make up the backup, or the directory of directory backups.
+}
+
+// Prune deletes the backups in `config.DestinationDir` that the retention policy doesn't keep, without backing anything up.
+// Each deleted backup is logged. Returns every error that occurred. `logger` may be nil.
+func Prune(config Config, logger *log.Logger) []error {
+	e := newErrorHandler(logger)
+	e.catch(func() {
+		e.panicIfErr(config.setDefaults())
+		location, err := config.location()
+		e.panicIfErr(err)
+		dstDirPath, err := filepath.Abs(config.DestinationDir)
+		e.panicIfErr(err)
+		// Don't delete backups while one is being written.
+		releaseLock, err := acquireLock(dstDirPath)
+		e.panicIfErr(err)
+		defer releaseLock()
+		pruneBackups(e, &config, filepath.Join(dstDirPath, "backups"), time.Now().In(location))
+	})
+	return e.errs
+}
+
+// Deletes the backups in `backupsDirPath` that the retention policy doesn't keep.
+// Ages are relative to `now`, and its location is the timezone used to group backups into days, weeks and months.
+func pruneBackups(e *errorHandler, config *Config, backupsDirPath string, now time.Time) {
+	// Only prune this machine's backups so backups from several machines can share a directory.
+	backups, err := findBackups(e, config, backupsDirPath)
+	if err != nil {
+		e.panic(errors.New("Unable to delete old backups: " + err.Error()))
+	}
+
+	var keep map[string]bool
+	if config.Retention.enabled() {
+		keep = gfsKeep(backups, config.Retention, now.Location())
+	} else {
+		keep = make(map[string]bool)
+		for i := len(backups) - config.RetentionCount; i < len(backups); i++ {
+			if i >= 0 {
+				keep[backups[i].name] = true
+			}
+		}
+	}
+	// Backups that are too old are deleted even if the other rules keep them.
+	if config.MaxAgeDays > 0 {
+		cutoff := now.Add(-time.Duration(config.MaxAgeDays) * 24 * time.Hour).Unix()
+		for _, backup := range backups {
+			if backup.unix < cutoff {
+				delete(keep, backup.name)
+			}
+		}
+	}
+	// Delete the oldest remaining backups until the rest fit, never deleting the newest.
+	if config.MaxTotalBytes > 0 && len(backups) > 0 {
+		var totalBytes int64
+		for _, backup := range backups {
+			if keep[backup.name] {
+				totalBytes += backup.size
+			}
+		}
+		for _, backup := range backups[:len(backups)-1] {
+			if totalBytes <= config.MaxTotalBytes {
+				break
+			}
+			if keep[backup.name] {
+				delete(keep, backup.name)
+				totalBytes -= backup.size
+			}
+		}
+	}
+
+	var keptCount int
+	var keptBytes int64
+	for _, backup := range backups {
+		if !keep[backup.name] {
+			e.logger.Printf("Deleting old backup %q", backup.name)
+			var removeErr error
+			for _, volume := range backup.volumes {
+				err := os.RemoveAll(filepath.Join(backupsDirPath, volume))
+				if err != nil {
+					e.print(err)
+					removeErr = err
+				}
+			}
+			for _, suffix := range []string{indexSuffix, checksumSuffix} {
+				err := os.Remove(filepath.Join(backupsDirPath, backup.name+suffix))
+				if err != nil && !os.IsNotExist(err) {
+					e.print(err)
+				}
+			}
+			if removeErr == nil {
+				continue
+			}
+		}
+		keptCount++
+		keptBytes += backup.size
+	}
+	e.logger.Printf("%d backups totalling %d bytes remain.", keptCount, keptBytes)
+}
+
+// Returns this machine's backups in `backupsDirPath`, oldest first. Errors getting the size of directory backups are printed.
+func findBackups(e *errorHandler, config *Config, backupsDirPath string) ([]backupFile, error) {
+	dirRegs, err := backupNameRegs(config, "")
+	if err != nil {
+		return nil, err
+	}
+	fileRegs, err := backupNameRegs(config, "(?:-incremental)?\\.(?:zip|tar\\.gz)(?:\\.enc)?")
+	if err != nil {
+		return nil, err
+	}
+	backupInfos, err := ioutil.ReadDir(backupsDirPath)
+	if err != nil {
+		return nil, err
+	}
+	// The volumes of split backups are grouped so they are kept or deleted together.
+	volumeReg := regexp.MustCompile("\\.\\d{3,}$")
+	backupIndexes := make(map[string]int)
+	backups := make([]backupFile, 0)
+	for _, info := range backupInfos {
+		if info.IsDir() {
+			unix, ok := matchBackupName(dirRegs, info.Name())
+			if !ok {
+				continue
+			}
+			size, err := dirSize(filepath.Join(backupsDirPath, info.Name()))
+			if err != nil {
+				e.print(err)
+			}
+			backups = append(backups, backupFile{name: info.Name(), unix: unix, size: size, volumes: []string{info.Name()}})
+			continue
+		}
+		name := volumeReg.ReplaceAllString(info.Name(), "")
+		unix, ok := matchBackupName(fileRegs, name)
+		if !ok {
+			continue
+		}
+		i, ok := backupIndexes[name]
+		if !ok {
+			i = len(backups)
+			backupIndexes[name] = i
+			backups = append(backups, backupFile{name: name, unix: unix})
+		}
+		backups[i].size += info.Size()
+		backups[i].volumes = append(backups[i].volumes, info.Name())
+	}
+	// Sort oldest first by timestamp rather than name so the width of the timestamp doesn't matter.
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].unix != backups[j].unix {
+			return backups[i].unix < backups[j].unix
+		}
+		return backups[i].name < backups[j].name
+	})
+	return backups, nil
+}
+
+// Returns why the backup at `now` should be skipped if the newest backup in `backupsDirPath` was taken less than `config.MinIntervalHours` before it, or an empty string.
+// Guards against schedulers starting the same backup twice, which would use up a retention slot.
+func withinMinInterval(e *errorHandler, config *Config, backupsDirPath string, now time.Time) (string, error) {
+	backups, err := findBackups(e, config, backupsDirPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(backups) == 0 {
+		return "", nil
+	}
+	newest := backups[len(backups)-1]
+	age := now.Sub(time.Unix(newest.unix, 0))
+	if age >= time.Duration(config.MinIntervalHours)*time.Hour {
+		return "", nil
+	}
+	return fmt.Sprintf("Skipped backup because %q was taken %s ago, within minIntervalHours %d.", newest.name, age.Round(time.Second), config.MinIntervalHours), nil
+}
+
+// Returns the names of the backups to keep under a grandfather-father-son policy.
+// The newest backup in each of the most recent `retention.Daily` days, `retention.Weekly` weeks and `retention.Monthly` months that have backups is kept.
+// `backups` must be sorted oldest first.
+func gfsKeep(backups []backupFile, retention Retention, location *time.Location) map[string]bool {
+	periods := []struct {
+		count int
+		key   func(t time.Time) string
+	}{
+		{retention.Daily, func(t time.Time) string {
+			return t.Format("2006-01-02")
+		}},
+		{retention.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{retention.Monthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		}},
+	}
+	keep := make(map[string]bool)
+	for _, period := range periods {
+		seen := make(map[string]bool)
+		for i := len(backups) - 1; i >= 0 && len(seen) < period.count; i-- {
+			key := period.key(time.Unix(backups[i].unix, 0).In(location))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			keep[backups[i].name] = true
+		}
+	}
+	return keep
+}
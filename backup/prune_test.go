@@ -0,0 +1,250 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// Pruning is tested relative to a fixed time so backups fall in known days, weeks and months.
+var testNow = time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+
+// Returns the name of this machine's zip backup taken `age` before `testNow`.
+func testBackupName(t *testing.T, config *Config, age time.Duration) string {
+	t.Helper()
+	name, err := backupName(config, testNow.Add(-age))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return name + ".zip"
+}
+
+// Runs `pruneBackups` over `backupsDirPath` at `testNow` and returns the names left in it, sorted.
+func pruneTestDir(t *testing.T, config Config, backupsDirPath string) []string {
+	t.Helper()
+	e := newErrorHandler(nil)
+	e.catch(func() {
+		pruneBackups(e, &config, backupsDirPath, testNow)
+	})
+	if len(e.errs) > 0 {
+		t.Fatal(e.errs)
+	}
+	entries, err := os.ReadDir(backupsDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestMaxAgeDays(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		ages   []time.Duration // Oldest first.
+		kept   []bool
+	}{
+		{
+			name:   "exactly max age is kept",
+			config: Config{MaxAgeDays: 30, RetentionCount: 10},
+			ages:   []time.Duration{30*day + time.Second, 30 * day, 30*day - time.Second, 0},
+			kept:   []bool{false, true, true, true},
+		},
+		{
+			name:   "zero is unlimited",
+			config: Config{RetentionCount: 10},
+			ages:   []time.Duration{3650 * day, 0},
+			kept:   []bool{true, true},
+		},
+		{
+			name:   "deleted when retentionCount keeps it",
+			config: Config{MaxAgeDays: 1, RetentionCount: 10},
+			ages:   []time.Duration{2 * day, day + time.Second, day, 0},
+			kept:   []bool{false, false, true, true},
+		},
+		{
+			name:   "deleted by retentionCount within max age",
+			config: Config{MaxAgeDays: 30, RetentionCount: 2},
+			ages:   []time.Duration{3 * day, 2 * day, day},
+			kept:   []bool{false, true, true},
+		},
+		{
+			// Each backup is in a different month except the two in September, of which the newest is kept.
+			name:   "deleted when retention keeps it",
+			config: Config{MaxAgeDays: 30, Retention: Retention{Monthly: 12}},
+			ages:   []time.Duration{90 * day, 60 * day, 31 * day, 30 * day, 0},
+			kept:   []bool{false, false, false, true, true},
+		},
+		{
+			name:   "deleted by retention within max age",
+			config: Config{MaxAgeDays: 30, Retention: Retention{Daily: 2}},
+			ages:   []time.Duration{2 * day, day, 0},
+			kept:   []bool{false, true, true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.NamePrefix = "test"
+			dirPath := t.TempDir()
+			names := make([]string, len(test.ages))
+			for i, age := range test.ages {
+				names[i] = testBackupName(t, &test.config, age)
+				err := os.WriteFile(filepath.Join(dirPath, names[i]), nil, 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			left := make(map[string]bool)
+			for _, name := range pruneTestDir(t, test.config, dirPath) {
+				left[name] = true
+			}
+			for i, name := range names {
+				if left[name] != test.kept[i] {
+					t.Errorf("Backup %s old kept is %t, want %t.", test.ages[i], left[name], test.kept[i])
+				}
+			}
+		})
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	config := Config{NamePrefix: "test"}
+	other := Config{NamePrefix: "other"}
+	old := testBackupName(t, &config, 2*day)
+	middle := testBackupName(t, &config, day)
+	newest := testBackupName(t, &config, 0)
+	trim := func(name string) string {
+		return name[:len(name)-len(".zip")]
+	}
+	tests := []struct {
+		name   string
+		config Config
+		files  map[string]int // Sizes by name. Names ending in a slash are directories containing a file of that size.
+		want   []string
+	}{
+		{
+			name:   "oldest deleted",
+			config: Config{RetentionCount: 2},
+			files:  map[string]int{old: 0, middle: 0, newest: 0},
+			want:   []string{middle, newest},
+		},
+		{
+			name:   "volumes deleted together",
+			config: Config{RetentionCount: 1},
+			files:  map[string]int{old + ".001": 0, old + ".002": 0, newest + ".001": 0, newest + ".002": 0},
+			want:   []string{newest + ".001", newest + ".002"},
+		},
+		{
+			name:   "index and checksum deleted with backup",
+			config: Config{RetentionCount: 1},
+			files: map[string]int{
+				old: 0, old + indexSuffix: 0, old + checksumSuffix: 0,
+				newest: 0, newest + indexSuffix: 0, newest + checksumSuffix: 0,
+			},
+			want: []string{newest, newest + checksumSuffix, newest + indexSuffix},
+		},
+		{
+			name:   "other kinds deleted",
+			config: Config{RetentionCount: 1},
+			files: map[string]int{
+				trim(old) + "-incremental.zip": 0, trim(old) + ".tar.gz": 0, trim(old) + ".zip.enc": 0, trim(old) + "/": 0,
+				newest: 0,
+			},
+			want: []string{newest},
+		},
+		{
+			name:   "other machines and files left",
+			config: Config{RetentionCount: 1},
+			files: map[string]int{
+				old: 0, newest: 0,
+				testBackupName(t, &other, 3*day): 0, "notes.txt": 0, trim(old) + ".txt": 0,
+			},
+			want: []string{newest, testBackupName(t, &other, 3*day), "notes.txt", trim(old) + ".txt"},
+		},
+		{
+			name:   "oldest deleted until the rest fit",
+			config: Config{RetentionCount: 10, MaxTotalBytes: 15},
+			files:  map[string]int{old: 10, middle: 10, trim(newest) + "/": 5},
+			want:   []string{middle, trim(newest)},
+		},
+		{
+			name:   "newest never deleted to fit",
+			config: Config{RetentionCount: 10, MaxTotalBytes: 15},
+			files:  map[string]int{old: 10, newest: 20},
+			want:   []string{newest},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.config.NamePrefix = config.NamePrefix
+			dirPath := t.TempDir()
+			for name, size := range test.files {
+				path := filepath.Join(dirPath, name)
+				if name[len(name)-1] == '/' {
+					err := os.Mkdir(path, os.ModePerm)
+					if err != nil {
+						t.Fatal(err)
+					}
+					path = filepath.Join(path, "file")
+				}
+				err := os.WriteFile(path, make([]byte, size), 0666)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			sort.Strings(test.want)
+			got := pruneTestDir(t, test.config, dirPath)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("Left %q, want %q.", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dstDirPath := t.TempDir()
+	backupsDirPath := filepath.Join(dstDirPath, "backups")
+	err := os.Mkdir(backupsDirPath, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{Sources: []Source{{Path: t.TempDir()}}, DestinationDir: dstDirPath, NamePrefix: "test", RetentionCount: 1}
+	now := time.Now()
+	var names []string
+	for _, age := range []time.Duration{day, 0} {
+		name, err := backupName(&config, now.Add(-age))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name+".zip")
+		err = os.WriteFile(filepath.Join(backupsDirPath, name+".zip"), nil, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs := Prune(config, nil)
+	if len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	entries, err := os.ReadDir(backupsDirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != names[1] {
+		t.Fatalf("Left %v, want only %q.", entries, names[1])
+	}
+	// The lock is released.
+	_, err = os.Stat(filepath.Join(dstDirPath, "backup.lock"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("Lock file left: %v", err)
+	}
+}
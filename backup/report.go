@@ -0,0 +1,1219 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	netsmtp "net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type salesScribeContact struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+}
+
+type salesScribeRequest struct {
+	DynamicDataJSON string               `json:"DynamicDataJson"`
+	ToAddresses     []salesScribeContact `json:"ToAddresses"`
+	CcAddresses     []salesScribeContact `json:"CcAddresses,omitempty"`
+	BccAddresses    []salesScribeContact `json:"BccAddresses,omitempty"`
+}
+
+type sendGridAddress struct {
+	Email string `json:"email"`
+}
+
+type sendGridPersonalization struct {
+	To  []Contact `json:"to"`
+	CC  []Contact `json:"cc,omitempty"`
+	BCC []Contact `json:"bcc,omitempty"`
+}
+
+type sendGridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendGridAttachment struct {
+	Content     string `json:"content"` // Base64 encoded.
+	Filename    string `json:"filename"`
+	Type        string `json:"type"`
+	Disposition string `json:"disposition"`
+}
+
+type sendGridRequest struct {
+	Personalizations []sendGridPersonalization `json:"personalizations"`
+	From             sendGridAddress           `json:"from"`
+	ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+	Subject          string                    `json:"subject"`
+	Content          []sendGridContent         `json:"content"`
+	Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+}
+
+type sesDestination struct {
+	ToAddresses  []string `json:"ToAddresses"`
+	CcAddresses  []string `json:"CcAddresses,omitempty"`
+	BccAddresses []string `json:"BccAddresses,omitempty"`
+}
+
+type sesRawMessage struct {
+	Data []byte `json:"Data"` // Base64 encoded when marshalled.
+}
+
+type sesContent struct {
+	Raw sesRawMessage `json:"Raw"`
+}
+
+type sesRequest struct {
+	FromEmailAddress string         `json:"FromEmailAddress"`
+	Destination      sesDestination `json:"Destination"`
+	Content          sesContent     `json:"Content"`
+}
+
+// Report emails the errors in `result` to the error contacts, or its summary if `NotifyOnSuccess` is set.
+// It is also sent to the webhook, Slack, Teams, Telegram and Discord if enabled. Reports still being sent are abandoned once `ctx` is done.
+func Report(ctx context.Context, config Config, result Result) {
+	logger := config.logger()
+	// Run may have failed before applying defaults. Out of range values are reported by Run.
+	config.setDefaults()
+
+	// The webhook, Slack, Teams, Telegram and Discord don't need contacts.
+	if len(config.ErrorContacts) == 0 && !config.WebhookEnable && !config.SlackEnable && !config.TeamsEnable && !config.TelegramEnable && !config.DiscordEnable {
+		withLevel(logger, "warning").Print("Warning: No error contacts were specified.")
+		return
+	}
+
+	var subject, message string
+	var runLog []byte // Only attached to failure reports.
+	if len(result.Errors) == 0 {
+		// Only report success if enabled. Skipped backups weren't taken so aren't a success to report.
+		if !config.NotifyOnSuccess || result.Skipped != "" {
+			logger.Print("No errors occurred.")
+			return
+		}
+		subject = "Backed up " + config.Name
+		message = fmt.Sprintf("Backed up %s successfully to %s.\n%s\n", config.Name, filepath.Base(result.ArchivePath), result.Summary())
+	} else {
+		subject = "Errors while backing up " + config.Name
+
+		// Concat the errors that occurred, grouping repeats and stopping at the limit so the report stays small enough to deliver.
+		var errorsString string
+		remaining := len(result.Errors)
+		for i, group := range groupErrors(result.Errors) {
+			if i == config.ReportMaxErrorsInBody {
+				errorsString += fmt.Sprintf("...and %d more errors. The full list is in the log", remaining)
+				if config.LogPath != "" {
+					errorsString += fmt.Sprintf(" at %s", config.LogPath)
+				}
+				errorsString += ".\n"
+				break
+			}
+			errorsString += group.String() + "\n"
+			remaining -= group.count
+		}
+
+		// Attach the log so the cause can be found without logging in to the machine.
+		var logNote string
+		if config.AttachLog {
+			var truncated bool
+			var err error
+			runLog, truncated, err = readRunLog(&config)
+			if err != nil {
+				withLevel(logger, "error").Print(fmt.Errorf("Unable to read log for report: %w", err).Error())
+			} else if truncated {
+				logNote = fmt.Sprintf("\nThe log is included in the report email. It was truncated to the last %d bytes.\n", config.AttachLogMaxBytes)
+			} else {
+				logNote = "\nThe log is included in the report email.\n"
+			}
+		}
+		message = fmt.Sprintf("Errors occurred while backing up %s:\n%s\n%s\n%s", config.Name, errorsString, result.Summary(), logNote)
+	}
+
+	sendReport(ctx, logger, &config, reportTransports(&config, subject, message, len(result.Errors), runLog))
+}
+
+// Errors that are the same apart from the path they happened to.
+type errorGroup struct {
+	message  string // The error with its path replaced by "<path>", or the error of groups of one.
+	count    int
+	examples []string // The first few paths.
+}
+
+// Number of example paths listed for each group of errors.
+const errorGroupExamples = 2
+
+func (g errorGroup) String() string {
+	if g.count == 1 {
+		return g.message
+	}
+	s := fmt.Sprintf("%d× %s", g.count, g.message)
+	if len(g.examples) > 0 {
+		s += " (e.g. " + strings.Join(g.examples, ", ") + ")"
+	}
+	return s
+}
+
+// Groups `errs` whose messages only differ by the path of their `os.PathError` so an outage affecting many files doesn't bury other errors.
+// Groups are in the order of their first error.
+func groupErrors(errs []error) []errorGroup {
+	groups := make([]errorGroup, 0)
+	indexes := make(map[string]int) // Of groups by normalized message.
+	for _, err := range errs {
+		message := err.Error()
+		key := message
+		var path string
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) && pathErr.Path != "" {
+			path = pathErr.Path
+			key = strings.ReplaceAll(message, path, "<path>")
+		}
+		i, ok := indexes[key]
+		if !ok {
+			indexes[key] = len(groups)
+			groups = append(groups, errorGroup{message: message, count: 1})
+			if path != "" {
+				groups[len(groups)-1].examples = []string{path}
+			}
+			continue
+		}
+		group := &groups[i]
+		// Groups of one show the original error, so the normalized message is only needed once there are more.
+		group.message = key
+		group.count++
+		if path != "" && len(group.examples) < errorGroupExamples {
+			group.examples = append(group.examples, path)
+		}
+	}
+	return groups
+}
+
+// TestReport sends a clearly marked test message through every enabled report transport so delivery can be checked without a failure.
+// Returns the error from each transport that failed. Nothing is backed up.
+func TestReport(ctx context.Context, config Config) []error {
+	logger := config.logger()
+	config.setDefaults()
+
+	subject := "TEST: Test report from " + config.Name
+	message := fmt.Sprintf("This is a test report from the backup of %s. No backup was run and nothing is wrong.\nIf you can read this, reports are delivered.\n", config.Name)
+	transports := reportTransports(&config, subject, message, 0, nil)
+	enabled := false
+	for _, transport := range transports {
+		enabled = enabled || transport.enabled
+	}
+	if !enabled {
+		err := errors.New("No report transports are enabled. Email transports also need errorContacts.")
+		withLevel(logger, "error").Print(err.Error())
+		return []error{err}
+	}
+	return sendReport(ctx, logger, &config, transports)
+}
+
+// A way of sending reports.
+type reportTransport struct {
+	description string // Follows "Sending report" in logs.
+	enabled     bool
+	send        func(ctx context.Context) error
+}
+
+// Returns every report transport, with `enabled` set for those that are configured.
+// `runLog` is attached to emails if it is not nil.
+func reportTransports(config *Config, subject, message string, errorCount int, runLog []byte) []reportTransport {
+	hasContacts := len(config.ErrorContacts) > 0
+	return []reportTransport{
+		{"email via SalesScribe", config.SalesScribeEnable && hasContacts, func(ctx context.Context) error {
+			return salesScribe(ctx, config, subject, message, runLog)
+		}},
+		{"email via SendGrid", config.SendGridEnable && hasContacts, func(ctx context.Context) error {
+			return sendGrid(ctx, config, subject, message, runLog)
+		}},
+		{"email via SMTP", config.SMTPEnable && hasContacts, func(ctx context.Context) error {
+			return smtp(ctx, config, subject, message, runLog)
+		}},
+		{"email via SES", config.SESEnable && hasContacts, func(ctx context.Context) error {
+			return ses(ctx, config, subject, message, runLog)
+		}},
+		{"email via Mailgun", config.MailgunEnable && hasContacts, func(ctx context.Context) error {
+			return mailgun(ctx, config, subject, message, runLog)
+		}},
+		{"to webhook", config.WebhookEnable, func(ctx context.Context) error {
+			return webhook(ctx, config, subject, message, errorCount)
+		}},
+		{"to Slack", config.SlackEnable, func(ctx context.Context) error {
+			return slack(ctx, config, subject, message)
+		}},
+		{"to Teams", config.TeamsEnable, func(ctx context.Context) error {
+			return teams(ctx, config, subject, message, errorCount)
+		}},
+		{"to Telegram", config.TelegramEnable, func(ctx context.Context) error {
+			return telegram(ctx, config, subject, message)
+		}},
+		{"to Discord", config.DiscordEnable, func(ctx context.Context) error {
+			return discord(ctx, config, subject, message, errorCount)
+		}},
+	}
+}
+
+// Sends a report through every enabled transport at once so a slow transport doesn't delay the others, logging the outcome of each as it finishes.
+// Each transport gives up after `reportTransportTimeout`. Returns the errors from transports that failed, in the order of `transports`.
+func sendReport(ctx context.Context, logger *log.Logger, config *Config, transports []reportTransport) []error {
+	type outcome struct {
+		index int
+		err   error
+	}
+	outcomes := make(chan outcome)
+	sending := 0
+	for i, transport := range transports {
+		if !transport.enabled {
+			continue
+		}
+		logger.Printf("Sending report %s.", transport.description)
+		sending++
+		go func(i int, transport reportTransport) {
+			transportCtx, cancel := context.WithTimeout(ctx, reportTransportTimeout(config))
+			defer cancel()
+			outcomes <- outcome{i, transport.send(transportCtx)}
+		}(i, transport)
+	}
+
+	// Outcomes are logged here as transports finish. Attempts are logged by `doReportRequest` in each goroutine, which `log.Logger` allows.
+	transportErrs := make([]error, len(transports))
+	for ; sending > 0; sending-- {
+		o := <-outcomes
+		if o.err != nil {
+			withLevel(logger, "error").Print(o.err.Error())
+			transportErrs[o.index] = o.err
+			continue
+		}
+		logger.Printf("Sent report %s.", transports[o.index].description)
+	}
+	errs := make([]error, 0)
+	for _, err := range transportErrs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// Returns how long a transport may take to send a report, which is long enough for every attempt `doReportRequest` makes and the waits between them.
+// It also stops SMTP, which doesn't retry, from hanging on an unresponsive server.
+func reportTransportTimeout(config *Config) time.Duration {
+	retries := config.ReportMaxRetries
+	// Reports are still sent when validation fails, so keep the shift below from overflowing.
+	if retries > 10 {
+		retries = 10
+	}
+	attempts := time.Duration(retries + 1)
+	// The waits double from 1 second.
+	backoff := time.Duration(1<<retries-1) * time.Second
+	// The extra second lets the last attempt time out itself, which gives a clearer error.
+	return attempts*time.Duration(config.ReportTimeoutSeconds)*time.Second + backoff + time.Second
+}
+
+func salesScribe(ctx context.Context, config *Config, subject, message string, runLog []byte) error {
+	if config.SalesScribeAPIKey == "" {
+		return errors.New("No SalesScribe API key for report email.")
+	}
+
+	if runLog != nil {
+		// SalesScribe doesn't support attachments so include the log in the message.
+		message += "\nLog:\n" + string(runLog)
+	}
+
+	// The template data is itself JSON, sent as a string.
+	dynamicData, err := json.Marshal(struct {
+		Email    string `json:"email"`
+		FullName string `json:"fullName"`
+		Subject  string `json:"subject"`
+		Message  string `json:"message"`
+	}{config.ErrorContacts[0].Email, config.ErrorContacts[0].Name, subject, message})
+	if err != nil {
+		return err
+	}
+	requestBody, err := json.Marshal(salesScribeRequest{
+		DynamicDataJSON: string(dynamicData),
+		ToAddresses:     salesScribeContacts(config.ErrorContacts),
+		CcAddresses:     salesScribeContacts(config.CCContacts),
+		BccAddresses:    salesScribeContacts(config.BCCContacts),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Make SalesScribe request.
+	endpoint := config.SalesScribeEndpoint
+	if endpoint == "" {
+		endpoint = "https://integrate.salesscribe.com/v1"
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("ApiKey2", config.SalesScribeAPIKey)
+	request.Header.Set("content-type", "application/json")
+	response, err := doReportRequest(config, "SalesScribe", request)
+	if err != nil {
+		return fmt.Errorf("SalesScribe request failed: %w", err)
+	}
+	defer response.Body.Close()
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		// Read body
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			// Not critical; use failover body.
+			responseBody = []byte("Error retrieving response body")
+		}
+		return errors.New(fmt.Sprintf("SalesScribe returned non-200 status code \"%d\".\n\nReponse body: \"%s\".\n\nRequest body: \"%s\"", response.StatusCode, string(responseBody), string(requestBody)))
+	}
+
+	return nil
+}
+
+// Returns `contacts` as SalesScribe addresses, or nil if there are none so they are left out of requests.
+func salesScribeContacts(contacts []Contact) []salesScribeContact {
+	if len(contacts) == 0 {
+		return nil
+	}
+	addresses := make([]salesScribeContact, len(contacts))
+	for i, contact := range contacts {
+		addresses[i] = salesScribeContact{
+			Name:    contact.Name,
+			Address: contact.Email,
+		}
+	}
+	return addresses
+}
+
+func sendGrid(ctx context.Context, config *Config, subject, message string, runLog []byte) error {
+	if config.SendGridAPIKey == "" {
+		return errors.New("No SendGrid API key for report email.")
+	}
+
+	// SendGrid rejects empty cc and bcc lists so they are omitted when empty.
+	requestBodyStruct := sendGridRequest{
+		Personalizations: []sendGridPersonalization{{
+			To:  config.ErrorContacts,
+			CC:  config.CCContacts,
+			BCC: config.BCCContacts,
+		}},
+		From:    sendGridAddress{Email: config.SendGridFromAddress},
+		Subject: subject,
+		Content: []sendGridContent{{Type: "text/plain", Value: message}},
+	}
+	if config.ReportReplyTo != "" {
+		requestBodyStruct.ReplyTo = &sendGridAddress{Email: config.ReportReplyTo}
+	}
+	if runLog != nil {
+		requestBodyStruct.Attachments = []sendGridAttachment{{
+			Content:     base64.StdEncoding.EncodeToString(runLog),
+			Filename:    "log.txt",
+			Type:        "text/plain",
+			Disposition: "attachment",
+		}}
+	}
+	requestBody, err := json.Marshal(requestBodyStruct)
+	if err != nil {
+		return err
+	}
+
+	// Make SendGrid request.
+	endpoint := config.SendGridEndpoint
+	if endpoint == "" {
+		endpoint = "https://api.sendgrid.com/v3/mail/send"
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("authorization", "Bearer "+config.SendGridAPIKey)
+	request.Header.Set("content-type", "application/json")
+	response, err := doReportRequest(config, "SendGrid", request)
+	if err != nil {
+		return fmt.Errorf("SendGrid request failed: %w", err)
+	}
+	defer response.Body.Close()
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		// Read body
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			// Not critical; use error body.
+			responseBody = []byte("Error reading response body")
+		}
+		// Print SendGrid error.
+		return errors.New(fmt.Sprintf("SendGrid returned non-200 status code \"%d\".\n\nReponse body: \"%s\".\n\nRequest body: \"%s\"", response.StatusCode, string(responseBody), string(requestBody)))
+	}
+
+	return nil
+}
+
+// Sends the report email with the Amazon SES v2 API, signed with `config.SESAccessKey` or the AWS credentials in the environment.
+// The message is sent raw, built like SMTP emails, so the log can be attached.
+func ses(ctx context.Context, config *Config, subject, message string, runLog []byte) error {
+	accessKey, secretKey, sessionToken := config.SESAccessKey, config.SESSecretKey, ""
+	if accessKey == "" {
+		// The same variables the AWS CLI and SDKs read.
+		accessKey, secretKey, sessionToken = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if accessKey == "" || secretKey == "" {
+		return errors.New("No SES credentials for report email. Set sesAccessKey and sesSecretKey or the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.")
+	}
+
+	body, err := emailMessage(config, config.SESFromAddress, subject, message, runLog)
+	if err != nil {
+		return err
+	}
+	requestBodyStruct := sesRequest{
+		FromEmailAddress: config.SESFromAddress,
+		Content:          sesContent{Raw: sesRawMessage{Data: body}},
+	}
+	for _, contact := range config.ErrorContacts {
+		requestBodyStruct.Destination.ToAddresses = append(requestBodyStruct.Destination.ToAddresses, contact.Email)
+	}
+	for _, contact := range config.CCContacts {
+		requestBodyStruct.Destination.CcAddresses = append(requestBodyStruct.Destination.CcAddresses, contact.Email)
+	}
+	for _, contact := range config.BCCContacts {
+		requestBodyStruct.Destination.BccAddresses = append(requestBodyStruct.Destination.BccAddresses, contact.Email)
+	}
+	requestBody, err := json.Marshal(requestBodyStruct)
+	if err != nil {
+		return err
+	}
+
+	endpoint := config.SESEndpoint
+	if endpoint == "" {
+		endpoint = "https://email." + config.SESRegion + ".amazonaws.com"
+	}
+	u, err := awsURL(endpoint, "/v2/email/outbound-emails", nil)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", u.String(), bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	// `http.NewRequestWithContext` re-parses the URL so restore the exact encoding that is signed.
+	request.URL = u
+	request.Header.Set("content-type", "application/json")
+	if sessionToken != "" {
+		request.Header.Set("x-amz-security-token", sessionToken)
+	}
+	payloadHash := sha256.Sum256(requestBody)
+	awsSign(request, hex.EncodeToString(payloadHash[:]), accessKey, secretKey, config.SESRegion, "ses", time.Now())
+	response, err := doReportRequest(config, "SES", request)
+	if err != nil {
+		return fmt.Errorf("SES request failed: %w", err)
+	}
+	defer response.Body.Close()
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			// Not critical; use error body.
+			responseBody = []byte("Error reading response body")
+		}
+		return fmt.Errorf("SES returned non-200 status code \"%d\".\n\nResponse body: \"%s\".", response.StatusCode, string(responseBody))
+	}
+	return nil
+}
+
+// Sends the report email with the Mailgun messages API as a multipart form so the log can be attached.
+func mailgun(ctx context.Context, config *Config, subject, message string, runLog []byte) error {
+	if config.MailgunAPIKey == "" {
+		return errors.New("No Mailgun API key for report email.")
+	}
+
+	var requestBody bytes.Buffer
+	form := multipart.NewWriter(&requestBody)
+	fields := [][2]string{{"from", config.MailgunFromAddress}, {"subject", subject}, {"text", message}}
+	for _, contact := range config.ErrorContacts {
+		fields = append(fields, [2]string{"to", (&mail.Address{Name: contact.Name, Address: contact.Email}).String()})
+	}
+	for _, contact := range config.CCContacts {
+		fields = append(fields, [2]string{"cc", (&mail.Address{Name: contact.Name, Address: contact.Email}).String()})
+	}
+	for _, contact := range config.BCCContacts {
+		fields = append(fields, [2]string{"bcc", contact.Email})
+	}
+	if config.ReportReplyTo != "" {
+		fields = append(fields, [2]string{"h:Reply-To", config.ReportReplyTo})
+	}
+	for _, field := range fields {
+		err := form.WriteField(field[0], field[1])
+		if err != nil {
+			return err
+		}
+	}
+	if runLog != nil {
+		part, err := form.CreateFormFile("attachment", "log.txt")
+		if err != nil {
+			return err
+		}
+		part.Write(runLog)
+	}
+	err := form.Close()
+	if err != nil {
+		return err
+	}
+
+	endpoint := config.MailgunEndpoint
+	if endpoint == "" {
+		endpoint = "https://api.mailgun.net"
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(endpoint, "/")+"/v3/"+url.PathEscape(config.MailgunDomain)+"/messages", bytes.NewReader(requestBody.Bytes()))
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth("api", config.MailgunAPIKey)
+	request.Header.Set("content-type", form.FormDataContentType())
+	response, err := doReportRequest(config, "Mailgun", request)
+	if err != nil {
+		return fmt.Errorf("Mailgun request failed: %w", err)
+	}
+	defer response.Body.Close()
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			// Not critical; use error body.
+			responseBody = []byte("Error reading response body")
+		}
+		return fmt.Errorf("Mailgun returned non-200 status code \"%d\".\n\nResponse body: \"%s\".", response.StatusCode, string(responseBody))
+	}
+	return nil
+}
+
+// Posts the report to `config.WebhookURL` as JSON.
+func webhook(ctx context.Context, config *Config, subject, message string, errorCount int) error {
+	if config.WebhookURL == "" {
+		return errors.New("No webhook URL for report.")
+	}
+
+	requestBody, err := json.Marshal(struct {
+		Name       string    `json:"name"`
+		Subject    string    `json:"subject"`
+		Message    string    `json:"message"`
+		ErrorCount int       `json:"errorCount"`
+		Timestamp  time.Time `json:"timestamp"`
+	}{
+		Name:       config.Name,
+		Subject:    subject,
+		Message:    message,
+		ErrorCount: errorCount,
+		Timestamp:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", config.WebhookURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	response, err := doReportRequest(config, "Webhook", request)
+	if err != nil {
+		return fmt.Errorf("Webhook request failed: %w", err)
+	}
+	defer response.Body.Close()
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			// Not critical; use error body.
+			responseBody = []byte("Error reading response body")
+		}
+		return fmt.Errorf("Webhook returned non-200 status code \"%d\".\n\nResponse body: \"%s\".", response.StatusCode, string(responseBody))
+	}
+	return nil
+}
+
+// Slack rejects header blocks longer than this.
+const slackMaxHeaderLength = 150
+
+// Slack rejects section blocks longer than this.
+const slackMaxSectionLength = 3000
+
+// Posts the report to a Slack incoming webhook with the subject as a title and the message in a code block.
+func slack(ctx context.Context, config *Config, subject, message string) error {
+	if config.SlackWebhookURL == "" {
+		return errors.New("No Slack webhook URL for report.")
+	}
+
+	header := truncate(subject, slackMaxHeaderLength)
+	// Leave room for the code block fences.
+	section := "```" + truncate(strings.TrimSpace(message), slackMaxSectionLength-6) + "```"
+
+	type slackText struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	type slackBlock struct {
+		Type string    `json:"type"`
+		Text slackText `json:"text"`
+	}
+	requestBody, err := json.Marshal(struct {
+		Text   string       `json:"text"` // Shown in notifications.
+		Blocks []slackBlock `json:"blocks"`
+	}{
+		Text: subject,
+		Blocks: []slackBlock{
+			{Type: "header", Text: slackText{Type: "plain_text", Text: header}},
+			{Type: "section", Text: slackText{Type: "mrkdwn", Text: section}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", config.SlackWebhookURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	response, err := doReportRequest(config, "Slack", request)
+	if err != nil {
+		return fmt.Errorf("Slack request failed: %w", err)
+	}
+	defer response.Body.Close()
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			// Not critical; use error body.
+			responseBody = []byte("Error reading response body")
+		}
+		return fmt.Errorf("Slack returned non-200 status code \"%d\".\n\nResponse body: \"%s\".", response.StatusCode, string(responseBody))
+	}
+	return nil
+}
+
+// Teams rejects messages larger than about 28 KB, including the rest of the card.
+const teamsMaxTextLength = 20000
+
+// Posts the report to a Teams incoming webhook as an adaptive card with the subject as a title, the name, status and error count as facts, and the message.
+func teams(ctx context.Context, config *Config, subject, message string, errorCount int) error {
+	if config.TeamsWebhookURL == "" {
+		return errors.New("No Teams webhook URL for report.")
+	}
+
+	status := "Succeeded"
+	color := "good"
+	if errorCount > 0 {
+		status = "Failed"
+		color = "attention"
+	}
+
+	type teamsFact struct {
+		Title string `json:"title"`
+		Value string `json:"value"`
+	}
+	type teamsElement struct {
+		Type     string      `json:"type"`
+		Text     string      `json:"text,omitempty"`
+		Size     string      `json:"size,omitempty"`
+		Weight   string      `json:"weight,omitempty"`
+		Color    string      `json:"color,omitempty"`
+		FontType string      `json:"fontType,omitempty"`
+		Wrap     bool        `json:"wrap,omitempty"`
+		Facts    []teamsFact `json:"facts,omitempty"`
+	}
+	type teamsCard struct {
+		Schema  string         `json:"$schema"`
+		Type    string         `json:"type"`
+		Version string         `json:"version"`
+		Body    []teamsElement `json:"body"`
+	}
+	type teamsAttachment struct {
+		ContentType string    `json:"contentType"`
+		Content     teamsCard `json:"content"`
+	}
+	requestBody, err := json.Marshal(struct {
+		Type        string            `json:"type"`
+		Attachments []teamsAttachment `json:"attachments"`
+	}{
+		Type: "message",
+		Attachments: []teamsAttachment{{
+			ContentType: "application/vnd.microsoft.card.adaptive",
+			Content: teamsCard{
+				Schema:  "http://adaptivecards.io/schemas/adaptive-card.json",
+				Type:    "AdaptiveCard",
+				Version: "1.4",
+				Body: []teamsElement{
+					{Type: "TextBlock", Text: subject, Size: "Medium", Weight: "Bolder", Color: color, Wrap: true},
+					{Type: "FactSet", Facts: []teamsFact{
+						{Title: "Backup", Value: config.Name},
+						{Title: "Status", Value: status},
+						{Title: "Errors", Value: strconv.Itoa(errorCount)},
+					}},
+					{Type: "TextBlock", Text: truncate(strings.TrimSpace(message), teamsMaxTextLength), FontType: "Monospace", Wrap: true},
+				},
+			},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", config.TeamsWebhookURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	response, err := doReportRequest(config, "Teams", request)
+	if err != nil {
+		return fmt.Errorf("Teams request failed: %w", err)
+	}
+	defer response.Body.Close()
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			// Not critical; use error body.
+			responseBody = []byte("Error reading response body")
+		}
+		return fmt.Errorf("Teams returned non-200 status code \"%d\".\n\nResponse body: \"%s\".", response.StatusCode, string(responseBody))
+	}
+	return nil
+}
+
+// Base URL of the Telegram Bot API.
+const telegramAPIURL = "https://api.telegram.org"
+
+// Telegram rejects messages longer than this.
+const telegramMaxMessageLength = 4096
+
+// Sends the report as a Telegram message from a bot, with the subject on the first line. Long messages are truncated.
+func telegram(ctx context.Context, config *Config, subject, message string) error {
+	if config.TelegramBotToken == "" || config.TelegramChatID == "" {
+		return errors.New("No Telegram bot token or chat ID for report.")
+	}
+
+	requestBody, err := json.Marshal(struct {
+		ChatID string `json:"chat_id"`
+		Text   string `json:"text"`
+	}{
+		ChatID: config.TelegramChatID,
+		Text:   truncate(subject+"\n\n"+strings.TrimSpace(message), telegramMaxMessageLength),
+	})
+	if err != nil {
+		return err
+	}
+
+	// The token is part of the URL so it is removed from errors.
+	request, err := http.NewRequestWithContext(ctx, "POST", telegramAPIURL+"/bot"+config.TelegramBotToken+"/sendMessage", bytes.NewReader(requestBody))
+	if err != nil {
+		return errors.New(strings.ReplaceAll(err.Error(), config.TelegramBotToken, mask(config.TelegramBotToken)))
+	}
+	request.Header.Set("content-type", "application/json")
+	response, err := doReportRequest(config, "Telegram", request)
+	if err != nil {
+		return fmt.Errorf("Telegram request failed: %s", strings.ReplaceAll(err.Error(), config.TelegramBotToken, mask(config.TelegramBotToken)))
+	}
+	defer response.Body.Close()
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			// Not critical; use error body.
+			responseBody = []byte("Error reading response body")
+		}
+		return fmt.Errorf("Telegram returned non-200 status code \"%d\".\n\nResponse body: \"%s\".", response.StatusCode, string(responseBody))
+	}
+	return nil
+}
+
+// Discord rejects messages, embed titles and embed descriptions longer than these.
+const (
+	discordMaxContentLength     = 2000
+	discordMaxTitleLength       = 256
+	discordMaxDescriptionLength = 4096
+)
+
+// Embed colors for successful and failed backups.
+const (
+	discordGreen = 0x2ecc71
+	discordRed   = 0xe74c3c
+)
+
+// Posts the report to a Discord webhook with the subject as the message and an embed titled with the backup name containing the message.
+// The embed is red if errors occurred and green otherwise.
+func discord(ctx context.Context, config *Config, subject, message string, errorCount int) error {
+	if config.DiscordWebhookURL == "" {
+		return errors.New("No Discord webhook URL for report.")
+	}
+
+	color := discordGreen
+	if errorCount > 0 {
+		color = discordRed
+	}
+	title := config.Name
+	if title == "" {
+		title = "Backup"
+	}
+
+	type discordEmbed struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+		Color       int    `json:"color"`
+	}
+	requestBody, err := json.Marshal(struct {
+		Content string         `json:"content"` // Shown in notifications.
+		Embeds  []discordEmbed `json:"embeds"`
+	}{
+		Content: truncate(subject, discordMaxContentLength),
+		Embeds: []discordEmbed{{
+			Title:       truncate(title, discordMaxTitleLength),
+			Description: truncate(strings.TrimSpace(message), discordMaxDescriptionLength),
+			Color:       color,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, "POST", config.DiscordWebhookURL, bytes.NewReader(requestBody))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	response, err := doReportRequest(config, "Discord", request)
+	if err != nil {
+		return fmt.Errorf("Discord request failed: %w", err)
+	}
+	defer response.Body.Close()
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		responseBody, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			// Not critical; use error body.
+			responseBody = []byte("Error reading response body")
+		}
+		return fmt.Errorf("Discord returned non-200 status code \"%d\".\n\nResponse body: \"%s\".", response.StatusCode, string(responseBody))
+	}
+	return nil
+}
+
+// Returns the part of `config.LogPath` written since `config.LogOffset`, shortened to about the last `config.AttachLogMaxBytes` bytes.
+// The second return value is whether it was shortened.
+func readRunLog(config *Config) ([]byte, bool, error) {
+	if config.LogPath == "" {
+		return nil, false, errors.New("No log file to attach.")
+	}
+	file, err := os.Open(config.LogPath)
+	if err != nil {
+		return nil, false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	start := config.LogOffset
+	if start > info.Size() {
+		start = info.Size()
+	}
+	truncated := info.Size()-start > config.AttachLogMaxBytes
+	if truncated {
+		start = info.Size() - config.AttachLogMaxBytes
+	}
+	runLog := make([]byte, info.Size()-start)
+	_, err = io.ReadFull(io.NewSectionReader(file, start, int64(len(runLog))), runLog)
+	if err != nil {
+		return nil, false, err
+	}
+	if truncated {
+		// Drop the partial first line.
+		i := bytes.IndexByte(runLog, '\n')
+		if i >= 0 {
+			runLog = runLog[i+1:]
+		}
+	}
+	// The log is included in JSON request bodies.
+	return []byte(strings.ToValidUTF8(string(runLog), "\uFFFD")), truncated, nil
+}
+
+// Shortens `s` to at most `max` characters, marking that it was shortened.
+func truncate(s string, max int) string {
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+// Sends an email through an SMTP server. STARTTLS is used when the server supports it.
+func smtp(ctx context.Context, config *Config, subject, message string, runLog []byte) error {
+	if config.SMTPHost == "" {
+		return errors.New("No SMTP host for report email.")
+	}
+
+	port := config.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	address := net.JoinHostPort(config.SMTPHost, strconv.Itoa(port))
+
+	var auth netsmtp.Auth
+	if config.SMTPUsername != "" {
+		auth = netsmtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, config.SMTPHost)
+	}
+
+	// Every contact is a recipient, including BCC contacts, who are left out of the headers.
+	to := make([]string, 0)
+	for _, contacts := range [][]Contact{config.ErrorContacts, config.CCContacts, config.BCCContacts} {
+		for _, contact := range contacts {
+			to = append(to, contact.Email)
+		}
+	}
+	body, err := emailMessage(config, config.SMTPFromAddress, subject, message, runLog)
+	if err != nil {
+		return err
+	}
+	err = sendMail(ctx, address, config.SMTPHost, auth, config.SMTPFromAddress, to, body)
+	if err != nil {
+		return fmt.Errorf("SMTP request failed: %w", err)
+	}
+	return nil
+}
+
+// Builds the report email from `from` to the contacts, with `runLog` attached if it is not nil.
+func emailMessage(config *Config, from, subject, message string, runLog []byte) ([]byte, error) {
+	// BCC contacts are left out of the headers so they aren't seen.
+	toHeaders := make([]string, len(config.ErrorContacts))
+	for i, contact := range config.ErrorContacts {
+		toHeaders[i] = (&mail.Address{Name: contact.Name, Address: contact.Email}).String()
+	}
+	ccHeaders := make([]string, len(config.CCContacts))
+	for i, contact := range config.CCContacts {
+		ccHeaders[i] = (&mail.Address{Name: contact.Name, Address: contact.Email}).String()
+	}
+
+	// CRLF line endings are required by SMTP.
+	contentType := "text/plain; charset=utf-8"
+	content := strings.ReplaceAll(message, "\n", "\r\n")
+	if runLog != nil {
+		var multipartContent bytes.Buffer
+		multipartWriter := multipart.NewWriter(&multipartContent)
+		part, err := multipartWriter.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+		if err != nil {
+			return nil, err
+		}
+		part.Write([]byte(content))
+		part, err = multipartWriter.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"text/plain; charset=utf-8"},
+			"Content-Disposition":       {`attachment; filename="log.txt"`},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Lines must be at most 76 characters.
+		encoded := base64.StdEncoding.EncodeToString(runLog)
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+		multipartWriter.Close()
+		contentType = "multipart/mixed; boundary=" + multipartWriter.Boundary()
+		content = multipartContent.String()
+	}
+	var ccHeader string
+	if len(ccHeaders) > 0 {
+		ccHeader = "Cc: " + strings.Join(ccHeaders, ", ") + "\r\n"
+	}
+	var replyToHeader string
+	if config.ReportReplyTo != "" {
+		replyToHeader = "Reply-To: " + config.ReportReplyTo + "\r\n"
+	}
+	body := "From: " + from + "\r\n" +
+		"To: " + strings.Join(toHeaders, ", ") + "\r\n" +
+		ccHeader +
+		replyToHeader +
+		"Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"\r\n" +
+		content
+	return []byte(body), nil
+}
+
+// Does the same as `netsmtp.SendMail` but gives up once `ctx` is done.
+func sendMail(ctx context.Context, address, host string, auth netsmtp.Auth, from string, to []string, body []byte) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	// Closing the connection unblocks whichever command is in progress.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	c, err := netsmtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return errors.New("The SMTP server doesn't support authentication.")
+		}
+		err = c.Auth(auth)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, address := range to {
+		err = c.Rcpt(address)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Returns the HTTP transport for report requests. It uses `config.ReportProxyURL` if set, or else the proxy environment variables,
+// and trusts the certificates in `config.ReportCAFile` as well as the system's.
+func reportHTTPTransport(config *Config) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if config.ReportProxyURL != "" {
+		proxyURL, err := url.Parse(config.ReportProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid reportProxyURL %q.", redactURL(config.ReportProxyURL))
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if config.ReportCAFile != "" {
+		caPEM, err := ioutil.ReadFile(config.ReportCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read reportCAFile: %w", err)
+		}
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			// Only the given certificates are trusted if the system's can't be loaded.
+			roots = x509.NewCertPool()
+		}
+		if !roots.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("No PEM certificates in reportCAFile %q.", config.ReportCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+	return transport, nil
+}
+
+// Sends a report request, giving up on each attempt after the configured timeout.
+// Network errors, 5xx and 429 responses are retried up to `config.ReportMaxRetries` times with exponential backoff.
+// `service` names the recipient of the request in logs.
+func doReportRequest(config *Config, service string, request *http.Request) (*http.Response, error) {
+	timeout := time.Duration(config.ReportTimeoutSeconds) * time.Second
+	transport, err := reportHTTPTransport(config)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Transport: transport, Timeout: timeout}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			// The body was consumed by the previous attempt.
+			body, err := request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			request.Body = body
+		}
+		config.logger().Printf("Sending %s request (attempt %d of %d).", service, attempt, config.ReportMaxRetries+1)
+		response, err := httpClient.Do(request)
+		if err != nil {
+			timedOut := false
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				timedOut = true
+			}
+			// Leave out the URL, which may contain a token or be a secret webhook URL.
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			if timedOut {
+				err = fmt.Errorf("Request timed out after %s: %w", timeout, err)
+			}
+		} else if response.StatusCode/100 == 5 || response.StatusCode == http.StatusTooManyRequests {
+			if attempt > config.ReportMaxRetries {
+				return response, nil
+			}
+			response.Body.Close()
+			err = fmt.Errorf("Status code %d", response.StatusCode)
+		} else {
+			return response, nil
+		}
+		// Give up on errors caused by cancellation rather than the service.
+		if attempt > config.ReportMaxRetries || request.Context().Err() != nil {
+			return nil, err
+		}
+
+		config.logger().Printf("%s request failed: %s. Retrying in %s.", service, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-request.Context().Done():
+			return nil, request.Context().Err()
+		}
+		backoff *= 2
+	}
+}
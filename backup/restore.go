@@ -0,0 +1,201 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Matches the prefix given to each source's entries, capturing the source number and base name.
+var sourcePrefixReg = regexp.MustCompile("^source-(\\d+):-([^/]+)")
+
+// Restore extracts the backup at `backupPath` into `targetDirPath` and returns every error that occurred.
+// Zip and tar.gz backups are told apart by their names. `password` is only required for encrypted backups. `logger` may be nil.
+func Restore(backupPath, password, targetDirPath string, logger *log.Logger) []error {
+	e := newErrorHandler(logger)
+	e.catch(func() {
+		restore(e, backupPath, password, targetDirPath)
+	})
+	return e.errs
+}
+
+// Extracts the backup at `backupPath` into `targetDirPath`.
+// Each source is restored to a directory named after the base name of its original path.
+// If several sources share a base name, the source number is appended to keep them apart.
+// `password` is only required for encrypted backups.
+func restore(e *errorHandler, backupPath, password, targetDirPath string) {
+	// Relative targets like "." are made absolute so joined paths can be compared against them.
+	targetDirPath, err := filepath.Abs(targetDirPath)
+	e.panicIfErr(err)
+	a, closeBackup, err := openBackup(backupPath, password)
+	e.panicIfErr(err)
+	defer closeBackup()
+	// The target must exist for symlinks within it to be checked.
+	err = os.MkdirAll(targetDirPath, os.ModeDir|os.ModePerm)
+	e.panicIfErr(err)
+
+	// Find which source numbers use each base name.
+	baseNameSources := make(map[string]map[string]bool)
+	err = a.walk(func(entry archiveEntry) error {
+		match := sourcePrefixReg.FindStringSubmatch(entry.name)
+		if match == nil {
+			return nil
+		}
+		if baseNameSources[match[2]] == nil {
+			baseNameSources[match[2]] = make(map[string]bool)
+		}
+		baseNameSources[match[2]][match[1]] = true
+		return nil
+	})
+	e.panicIfErr(err)
+
+	var fileCount int
+	// Symlinks are created after everything else so files can't be written through them to outside the target directory.
+	links := make(map[string]string)
+	linkPaths := make([]string, 0)
+	err = a.walk(func(entry archiveEntry) error {
+		if entry.name == manifestName {
+			return nil
+		}
+		match := sourcePrefixReg.FindStringSubmatch(entry.name)
+		if match == nil {
+			e.print(fmt.Errorf("Unable to restore %q: Not part of a source.", entry.name))
+			return nil
+		}
+		dirName := match[2]
+		if len(baseNameSources[dirName]) > 1 {
+			dirName += "-" + match[1]
+		}
+		relPath := dirName + strings.TrimPrefix(entry.name, match[0])
+
+		// Refuse entries that would escape the target directory.
+		dstPath := filepath.Join(targetDirPath, filepath.FromSlash(relPath))
+		if !strings.HasPrefix(dstPath, filepath.Clean(targetDirPath)+string(filepath.Separator)) {
+			e.print(fmt.Errorf("Unable to restore %q: Path escapes the target directory.", entry.name))
+			return nil
+		}
+
+		if entry.linkTarget != "" {
+			links[dstPath] = entry.linkTarget
+			linkPaths = append(linkPaths, dstPath)
+			return nil
+		}
+		err := checkParentWithin(targetDirPath, dstPath)
+		if err == nil {
+			err = restoreFile(entry, dstPath)
+		}
+		if err != nil {
+			e.print(fmt.Errorf("Unable to restore %q: %w", entry.name, err))
+			return nil
+		}
+		fileCount++
+		return nil
+	})
+	e.panicIfErr(err)
+	for _, dstPath := range linkPaths {
+		// An earlier symlink may be a parent of this one.
+		err := checkParentWithin(targetDirPath, dstPath)
+		if err == nil {
+			err = restoreSymlink(links[dstPath], dstPath)
+		}
+		if err != nil {
+			e.print(fmt.Errorf("Unable to restore symlink %q: %w", dstPath, err))
+			continue
+		}
+		fileCount++
+	}
+
+	e.logger.Printf("Restored %d entries to %q.", fileCount, targetDirPath)
+}
+
+// Returns an error if the parent directory of `dstPath` resolves to outside `targetDirPath` through a symlink, e.g. one restored earlier, so nothing is written through it.
+// Only the deepest parent that exists is checked because directories created below it by restoring are real directories.
+func checkParentWithin(targetDirPath, dstPath string) error {
+	realTarget, err := filepath.EvalSymlinks(targetDirPath)
+	if err != nil {
+		return err
+	}
+	parent := filepath.Dir(dstPath)
+	for {
+		_, err := os.Lstat(parent)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent = filepath.Dir(parent)
+	}
+	realParent, err := filepath.EvalSymlinks(parent)
+	if err != nil {
+		return err
+	}
+	if realParent != realTarget && !strings.HasPrefix(realParent, realTarget+string(filepath.Separator)) {
+		return fmt.Errorf("%q is a symlink to outside the target directory.", parent)
+	}
+	return nil
+}
+
+// Writes a single entry to `dstPath`, restoring its modification time and attributes.
+func restoreFile(entry archiveEntry, dstPath string) error {
+	if entry.isDir {
+		err := os.MkdirAll(dstPath, os.ModeDir|os.ModePerm)
+		if err != nil {
+			return err
+		}
+		err = restoreModTime(entry, dstPath)
+		if err != nil {
+			return err
+		}
+		return restoreAttributes(entry, dstPath)
+	}
+
+	err := os.MkdirAll(filepath.Dir(dstPath), os.ModeDir|os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// Replace symlinks rather than writing through them.
+	info, err := os.Lstat(dstPath)
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		err = os.Remove(dstPath)
+		if err != nil {
+			return err
+		}
+	}
+	src, err := entry.open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		dst.Close()
+		return err
+	}
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	err = restoreModTime(entry, dstPath)
+	if err != nil {
+		return err
+	}
+	// Attributes are restored last because read-only files can't be modified.
+	return restoreAttributes(entry, dstPath)
+}
+
+func restoreModTime(entry archiveEntry, dstPath string) error {
+	if entry.modified.IsZero() {
+		return nil
+	}
+	return os.Chtimes(dstPath, entry.modified, entry.modified)
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestoreRelativeTarget(t *testing.T) {
+	srcPath := filepath.Join(t.TempDir(), "src")
+	err := os.MkdirAll(filepath.Join(srcPath, "dir"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"a.txt": "a", filepath.Join("dir", "b.txt"): "b"}
+	for path, content := range files {
+		err := os.WriteFile(filepath.Join(srcPath, path), []byte(content), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	result, err := Run(context.Background(), Config{Sources: []Source{{Path: srcPath}}, DestinationDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{".", filepath.Join("restored", "here")} {
+		t.Run(target, func(t *testing.T) {
+			dirPath := t.TempDir()
+			err := os.Chdir(dirPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Changed back before the directory is removed, which Windows doesn't allow while it's in use.
+			defer os.Chdir(wd)
+			errs := Restore(result.ArchivePath, "", target, nil)
+			if len(errs) > 0 {
+				t.Fatal(errs)
+			}
+			for path, content := range files {
+				got, err := os.ReadFile(filepath.Join(dirPath, target, "src", path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != content {
+					t.Fatalf("Restored %q as %q, want %q.", path, got, content)
+				}
+			}
+		})
+	}
+}
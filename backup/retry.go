@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Time between attempts to read a file or directory.
+const readRetryDelay = time.Second
+
+// Calls `f` until it succeeds or has been retried `config.FileReadRetries` times, waiting `readRetryDelay` between attempts.
+// Errors that won't go away by themselves, like missing files, aren't retried.
+func (w *walker) retry(ctx context.Context, path string, f func() error) error {
+	err := f()
+	for attempt := 0; attempt < w.config.FileReadRetries && err != nil && transient(err); attempt++ {
+		w.warn(fmt.Sprintf("Retrying %q after error: %s", path, err))
+		timer := time.NewTimer(readRetryDelay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = f()
+	}
+	return err
+}
+
+// Reports whether `err` might not happen again, e.g. an I/O error on a network share.
+func transient(err error) bool {
+	return !os.IsNotExist(err) && !os.IsPermission(err) && !isLocked(err) && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// Reads the file at `path`, reopening it and continuing from the same offset when a read fails, so transient errors don't fail the backup.
+type retryingFile struct {
+	w      *walker
+	ctx    context.Context
+	path   string
+	file   *os.File // nil after a failed read until it is reopened.
+	offset int64
+}
+
+// Opens the file at `path`, retrying up to `config.FileReadRetries` times.
+func (w *walker) openFile(ctx context.Context, path string) (*retryingFile, error) {
+	r := &retryingFile{w: w, ctx: ctx, path: path}
+	err := w.retry(ctx, path, r.reopen)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Opens the file and seeks to `offset`.
+func (r *retryingFile) reopen() error {
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(r.offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	return nil
+}
+
+func (r *retryingFile) Read(p []byte) (int, error) {
+	var n int
+	var eof bool
+	err := r.w.retry(r.ctx, r.path, func() error {
+		if r.file == nil {
+			err := r.reopen()
+			if err != nil {
+				return err
+			}
+		}
+		var err error
+		n, err = r.file.Read(p)
+		r.offset += int64(n)
+		if err == io.EOF {
+			eof = true
+			return nil
+		}
+		// Return what was read. An error reading the rest will happen again.
+		if err != nil && n == 0 {
+			r.file.Close()
+			r.file = nil
+			return err
+		}
+		return nil
+	})
+	if eof {
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// Only used to read the file again from the start.
+func (r *retryingFile) Seek(offset int64, whence int) (int64, error) {
+	if r.file == nil {
+		return 0, fmt.Errorf("Unable to seek %q after a failed read.", r.path)
+	}
+	n, err := r.file.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	r.offset = n
+	return n, nil
+}
+
+func (r *retryingFile) Close() error {
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Close()
+}
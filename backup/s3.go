@@ -0,0 +1,189 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 multipart uploads allow at most 10000 parts of at least 5 MiB.
+const (
+	s3MinPartSize  = 8 << 20
+	s3MaxPartCount = 10000
+)
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// Uploads the file at `filePath` to the configured S3 bucket using a multipart upload so it is never read fully into memory.
+// If `sha256Hex` is set the upload is abandoned unless the file's contents have that SHA-256. S3 checks each part against its signed SHA-256.
+func s3Upload(ctx context.Context, config *Config, filePath, sha256Hex string) error {
+	if config.S3Bucket == "" {
+		return errors.New("No S3 bucket for upload.")
+	}
+	if config.S3Region == "" {
+		return errors.New("No S3 region for upload.")
+	}
+	endpoint := config.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + config.S3Region + ".amazonaws.com"
+	}
+	key := strings.TrimPrefix(path.Join(config.S3Prefix, filepath.Base(filePath)), "/")
+	// Path style addressing is supported by all S3 compatible services.
+	objectPath := "/" + config.S3Bucket + "/" + key
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	partSize := int64(s3MinPartSize)
+	if info.Size()/s3MaxPartCount >= partSize {
+		partSize = info.Size()/s3MaxPartCount + 1
+	}
+
+	// Start upload.
+	responseBody, err := s3Request(ctx, config, endpoint, "POST", objectPath, url.Values{"uploads": {""}}, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiateResult struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.Unmarshal(responseBody, &initiateResult)
+	if err != nil {
+		return fmt.Errorf("Unable to parse S3 CreateMultipartUpload response: %w", err)
+	}
+	uploadID := initiateResult.UploadID
+
+	err = s3UploadParts(ctx, config, endpoint, objectPath, uploadID, file, partSize, newRateLimiter(config.UploadMaxBytesPerSecond), func(hash hash.Hash) error {
+		return checkUploadSHA256(filePath, hash, sha256Hex)
+	})
+	if err != nil {
+		// Abort so the bucket isn't charged for incomplete parts. The upload error is more useful than any abort error.
+		// The abort is not cancelled with `ctx` because it is still needed when the upload was cancelled.
+		s3Request(context.Background(), config, endpoint, "DELETE", objectPath, url.Values{"uploadId": {uploadID}}, nil, nil, nil)
+		return err
+	}
+	return nil
+}
+
+// Uploads `file` in parts then completes the upload if `check` accepts the SHA-256 of everything uploaded.
+func s3UploadParts(ctx context.Context, config *Config, endpoint, objectPath, uploadID string, file io.Reader, partSize int64, limiter *rateLimiter, check func(hash.Hash) error) error {
+	fileHash := sha256.New()
+	file = io.TeeReader(file, fileHash)
+	parts := make([]s3CompletedPart, 0)
+	buffer := make([]byte, partSize)
+	for partNumber := 1; ; partNumber++ {
+		n, err := io.ReadFull(file, buffer)
+		if err == io.EOF && partNumber > 1 {
+			break
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {uploadID},
+		}
+		header := make(http.Header)
+		_, err = s3Request(ctx, config, endpoint, "PUT", objectPath, query, buffer[:n], header, limiter)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, s3CompletedPart{
+			PartNumber: partNumber,
+			ETag:       header.Get("etag"),
+		})
+		if n < len(buffer) {
+			break
+		}
+	}
+
+	err := check(fileHash)
+	if err != nil {
+		return err
+	}
+
+	// Complete upload.
+	completeBody, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	responseBody, err := s3Request(ctx, config, endpoint, "POST", objectPath, url.Values{"uploadId": {uploadID}}, completeBody, nil, nil)
+	if err != nil {
+		return err
+	}
+	// S3 can report errors in the body of a 200 response to CompleteMultipartUpload.
+	if bytes.Contains(responseBody, []byte("<Error>")) {
+		return fmt.Errorf("S3 failed to complete upload.\n\nResponse body: \"%s\"", string(responseBody))
+	}
+	return nil
+}
+
+// Makes a signed request to S3 and returns the response body.
+// The response headers are copied to `responseHeader` if it is not nil. `body` is sent no faster than `limiter` allows if it is not nil.
+func s3Request(ctx context.Context, config *Config, endpoint, method, objectPath string, query url.Values, body []byte, responseHeader http.Header, limiter *rateLimiter) ([]byte, error) {
+	u, err := awsURL(endpoint, objectPath, query)
+	if err != nil {
+		return nil, err
+	}
+	var bodyReader io.Reader = bytes.NewReader(body)
+	if len(body) > 0 {
+		bodyReader = limiter.reader(ctx, bodyReader)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, u.String(), bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = int64(len(body))
+	// `http.NewRequestWithContext` re-parses the URL so restore the exact encoding that is signed.
+	request.URL = u
+	payloadHash := sha256.Sum256(body)
+	awsSign(request, hex.EncodeToString(payloadHash[:]), config.S3AccessKey, config.S3SecretKey, config.S3Region, "s3", time.Now())
+
+	httpClient := &http.Client{}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("S3 request failed: %w", err)
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	// If status code is not 2xx.
+	if response.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("S3 returned non-200 status code \"%d\" for %s %s.\n\nResponse body: \"%s\"", response.StatusCode, method, objectPath, string(responseBody))
+	}
+	if responseHeader != nil {
+		for name, values := range response.Header {
+			responseHeader[name] = values
+		}
+	}
+	return responseBody, nil
+}
@@ -0,0 +1,128 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Uploads the file at `filePath` to `config.SFTPRemoteDir` on the configured SFTP server.
+// The file is written to `<name>.partial` and renamed once complete so an interrupted upload is never mistaken for a backup.
+// If `sha256Hex` is set the upload is abandoned unless the file's contents have that SHA-256.
+func sftpUpload(ctx context.Context, config *Config, filePath, sha256Hex string) error {
+	if config.SFTPHost == "" {
+		return errors.New("No SFTP host for upload.")
+	}
+	if config.SFTPKnownHostsPath == "" {
+		return errors.New("No SFTP known_hosts file for upload. Host keys must be verified.")
+	}
+	hostKeyCallback, err := knownhosts.New(config.SFTPKnownHostsPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read SFTP known_hosts file: %w", err)
+	}
+	var auth []ssh.AuthMethod
+	if config.SFTPKeyPath != "" {
+		keyPEM, err := ioutil.ReadFile(config.SFTPKeyPath)
+		if err != nil {
+			return err
+		}
+		signer, err := ssh.ParsePrivateKey(keyPEM)
+		if err != nil {
+			return fmt.Errorf("Unable to parse SFTP private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if config.SFTPPassword != "" {
+		auth = append(auth, ssh.Password(config.SFTPPassword))
+	}
+	if len(auth) == 0 {
+		return errors.New("No SFTP key or password for upload.")
+	}
+	port := config.SFTPPort
+	if port == 0 {
+		port = 22
+	}
+	address := net.JoinHostPort(config.SFTPHost, strconv.Itoa(port))
+
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return err
+	}
+	// Closing the connection stops the upload when `ctx` is done.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, address, &ssh.ClientConfig{
+		User:            config.SFTPUsername,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	sshClient := ssh.NewClient(sshConn, chans, reqs)
+	defer sshClient.Close()
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	remotePath := path.Join(config.SFTPRemoteDir, filepath.Base(filePath))
+	remoteFile, err := client.Create(remotePath + ".partial")
+	if err != nil {
+		return fmt.Errorf("Unable to create %q on SFTP server: %w", remotePath+".partial", err)
+	}
+	fileHash := sha256.New()
+	_, err = io.Copy(remoteFile, newRateLimiter(config.UploadMaxBytesPerSecond).reader(ctx, io.TeeReader(file, fileHash)))
+	if err == nil {
+		err = checkUploadSHA256(filePath, fileHash, sha256Hex)
+	}
+	if err != nil {
+		remoteFile.Close()
+		client.Remove(remotePath + ".partial")
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	err = remoteFile.Close()
+	if err != nil {
+		client.Remove(remotePath + ".partial")
+		return err
+	}
+	// Overwrite any earlier upload of the same backup. Plain rename fails if the target exists on most servers.
+	err = client.PosixRename(remotePath+".partial", remotePath)
+	if err != nil {
+		err = client.Rename(remotePath+".partial", remotePath)
+	}
+	return err
+}
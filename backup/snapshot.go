@@ -0,0 +1,179 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Writes a backup to the directory `<path>.partial`, which is only given its final name by `commit`.
+// Files identical to those in the previous directory backup are hard linked to it rather than copied, so unchanged files only use disk space once.
+type snapshot struct {
+	e    *errorHandler
+	path string
+	// The newest earlier directory backup and its files by path. Empty if there isn't one.
+	previousPath  string
+	previousFiles map[string]manifestFile
+	linkWarning   sync.Once
+}
+
+// Creates `<path>.partial` and reads the manifest of this machine's newest directory backup in `backupsDirPath` so unchanged files can be linked to it.
+func newSnapshot(e *errorHandler, config *Config, backupsDirPath, path string) (*snapshot, error) {
+	s := &snapshot{e: e, path: path, previousFiles: make(map[string]manifestFile)}
+	err := os.Mkdir(path+".partial", os.ModeDir|os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	nameRegs, err := backupNameRegs(config, "")
+	if err != nil {
+		return nil, err
+	}
+	infos, err := ioutil.ReadDir(backupsDirPath)
+	if err != nil {
+		return nil, err
+	}
+	var previousUnix int64 = -1
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		unix, ok := matchBackupName(nameRegs, info.Name())
+		if !ok || unix < previousUnix {
+			continue
+		}
+		previousUnix = unix
+		s.previousPath = filepath.Join(backupsDirPath, info.Name())
+	}
+	if s.previousPath == "" {
+		return s, nil
+	}
+	manifestJSON, err := ioutil.ReadFile(filepath.Join(s.previousPath, manifestName))
+	if err != nil {
+		e.warn(fmt.Sprintf("Unable to read the manifest of the previous backup so every file will be copied: %s", err))
+		return s, nil
+	}
+	var m manifest
+	err = json.Unmarshal(manifestJSON, &m)
+	if err != nil {
+		e.warn(fmt.Sprintf("Unable to parse the manifest of the previous backup so every file will be copied: %s", err))
+		return s, nil
+	}
+	for _, f := range m.Files {
+		s.previousFiles[f.Path] = f
+	}
+	return s, nil
+}
+
+// Returns the path within the backup directory `backupPath` of the zip entry name `dstPath`.
+// The colon in the source prefix is removed because it isn't allowed in Windows file names.
+func snapshotFilePath(backupPath, dstPath string) string {
+	return filepath.Join(backupPath, filepath.FromSlash(strings.Replace(dstPath, ":", "", 1)))
+}
+
+// Backs up `src` to `dstPath`, hard linking the previous backup's copy if it has the same path, size, modification time and SHA-256.
+// `r` reads `src` and is only read once. Returns the size and hex encoded SHA-256 of `src` and whether it was linked.
+func (s *snapshot) add(ctx context.Context, dstPath string, info os.FileInfo, src io.ReadSeeker, r io.Reader) (int64, string, bool, error) {
+	path := snapshotFilePath(s.path+".partial", dstPath)
+	err := os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm)
+	if err != nil {
+		return 0, "", false, err
+	}
+
+	previousFile, ok := s.previousFiles[dstPath]
+	if ok && previousFile.Size == info.Size() {
+		previousPath := snapshotFilePath(s.previousPath, dstPath)
+		previousInfo, err := os.Stat(previousPath)
+		if err == nil && previousInfo.Size() == info.Size() && previousInfo.ModTime().Equal(info.ModTime()) {
+			hash := sha256.New()
+			n, err := io.Copy(hash, r)
+			if err != nil {
+				return 0, "", false, err
+			}
+			sum := hex.EncodeToString(hash.Sum(nil))
+			if sum == previousFile.SHA256 {
+				err = os.Link(previousPath, path)
+				if err == nil {
+					return n, sum, true, nil
+				}
+				s.linkWarning.Do(func() {
+					s.e.warn(fmt.Sprintf("Unable to hard link unchanged files so they will be copied. The destination's file system may not support hard links: %s", err))
+				})
+			}
+			// `r` has been read so copy `src` from the start without counting it towards progress again.
+			_, err = src.Seek(0, io.SeekStart)
+			if err != nil {
+				return 0, "", false, err
+			}
+			r = &contextReader{ctx: ctx, r: src}
+		}
+	}
+
+	dst, err := os.Create(path)
+	if err != nil {
+		return 0, "", false, err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, hash), r)
+	if err != nil {
+		dst.Close()
+		return 0, "", false, err
+	}
+	err = dst.Close()
+	if err != nil {
+		return 0, "", false, err
+	}
+	// Unchanged files are only linked if their modification times match.
+	err = os.Chtimes(path, info.ModTime(), info.ModTime())
+	if err != nil {
+		return 0, "", false, err
+	}
+	return n, hex.EncodeToString(hash.Sum(nil)), false, nil
+}
+
+// Creates the empty directory `dstPath`.
+func (s *snapshot) addDir(dstPath string) error {
+	return os.MkdirAll(snapshotFilePath(s.path+".partial", dstPath), os.ModeDir|os.ModePerm)
+}
+
+// Writes the manifest to the root of the backup. Must be called after all files have been added.
+func (s *snapshot) writeManifest(m manifest) error {
+	manifestJSON, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.path+".partial", manifestName), manifestJSON, 0666)
+}
+
+// Renames the backup to its final name.
+func (s *snapshot) commit() error {
+	return os.Rename(s.path+".partial", s.path)
+}
+
+// Deletes the partial backup.
+func (s *snapshot) remove() {
+	os.RemoveAll(s.path + ".partial")
+}
+
+// Returns the total size of the files in the directory at `path`. Hard linked files are counted in every directory that links them.
+func dirSize(path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"unicode/utf8"
+)
+
+// Compresses `src` to a temporary file then copies it into a new zip entry while holding `w.zipMu`.
+// Returns the uncompressed size and hex encoded SHA-256.
+func (w *walker) writeSpooled(header *zip.FileHeader, src io.Reader) (int64, string, error) {
+	spool, err := ioutil.TempFile("", "backup-*.tmp")
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	// Compress.
+	var compressed io.Writer = spool
+	var compressor io.WriteCloser
+	if header.Method == zip.Deflate {
+		level := flate.DefaultCompression
+		if w.config.CompressionLevel != nil {
+			level = *w.config.CompressionLevel
+		}
+		compressor, err = newDeflateWriter(spool, level, w.config.CompressionThreads)
+		if err != nil {
+			return 0, "", err
+		}
+		compressed = compressor
+	}
+	crc := crc32.NewIEEE()
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(compressed, crc, hash), src)
+	if err != nil {
+		return 0, "", err
+	}
+	if compressor != nil {
+		err = compressor.Close()
+		if err != nil {
+			return 0, "", err
+		}
+	}
+	compressedSize, err := spool.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, "", err
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, "", err
+	}
+
+	header.CRC32 = crc.Sum32()
+	// Only set the 64 bit sizes. `CreateRaw` switches to Zip64 when they exceed 4 GiB, like `CreateHeader` does.
+	header.UncompressedSize64 = uint64(n)
+	header.CompressedSize64 = uint64(compressedSize)
+	prepareRawHeader(header)
+
+	// Copy into zip.
+	w.zipMu.Lock()
+	defer w.zipMu.Unlock()
+	dst, err := w.zip.CreateRaw(header)
+	if err != nil {
+		return 0, "", err
+	}
+	_, err = io.Copy(dst, spool)
+	if err != nil {
+		return 0, "", err
+	}
+	w.compressedByteCount += compressedSize
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Sets the fields `zip.Writer.CreateHeader` would set, for use with `zip.Writer.CreateRaw`.
+func prepareRawHeader(header *zip.FileHeader) {
+	for _, r := range header.Name {
+		if r >= utf8.RuneSelf {
+			header.Flags |= 0x800 // UTF-8 name.
+			break
+		}
+	}
+	header.CreatorVersion = 20
+	header.ReaderVersion = 20
+	modified := header.Modified
+	header.SetModTime(modified)
+	// Add an extended timestamp field as `CreateHeader` does so the modification time isn't limited to MS-DOS precision.
+	extra := make([]byte, 9)
+	binary.LittleEndian.PutUint16(extra, 0x5455)
+	binary.LittleEndian.PutUint16(extra[2:], 5)
+	extra[4] = 1 // Modification time only.
+	binary.LittleEndian.PutUint32(extra[5:], uint32(modified.Unix()))
+	header.Extra = append(header.Extra, extra...)
+}
@@ -0,0 +1,91 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"os"
+	"path/filepath"
+)
+
+// Stores the symlink `srcPath` as a link to its target rather than a copy of it.
+// Links aren't listed in the manifest because they have no contents to check.
+func (w *walker) addSymlink(srcPath, dstPath string, info os.FileInfo) []error {
+	target, err := os.Readlink(srcPath)
+	if err != nil {
+		return w.fail(srcPath, err)
+	}
+	if w.counting() {
+		w.dryRunf("Would add symlink %q to %q", srcPath, target)
+		return []error{}
+	}
+	if w.snapshot != nil {
+		err = w.snapshot.addSymlink(dstPath, target)
+	} else {
+		if w.zipMu != nil {
+			w.zipMu.Lock()
+			defer w.zipMu.Unlock()
+		}
+		if w.tar != nil {
+			err = w.writeTarSymlink(dstPath, target, info)
+		} else {
+			err = w.writeZipSymlink(dstPath, target, info)
+		}
+	}
+	if err != nil {
+		return w.fail(srcPath, err)
+	}
+	w.verbosef("Added symlink %q to %q", srcPath, target)
+	return []error{}
+}
+
+// Zip entries are symlinks if their Unix mode says so, in which case their contents are the target.
+func (w *walker) writeZipSymlink(dstPath, target string, info os.FileInfo) error {
+	header := &zip.FileHeader{
+		Name:     dstPath,
+		Method:   zip.Store,
+		Modified: info.ModTime(),
+	}
+	header.SetMode(os.ModeSymlink | 0777)
+	dst, err := w.zip.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write([]byte(target))
+	return err
+}
+
+func (w *walker) writeTarSymlink(dstPath, target string, info os.FileInfo) error {
+	header, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return err
+	}
+	header.Name = dstPath
+	header.Format = tar.FormatPAX
+	return w.tar.WriteHeader(header)
+}
+
+// Creates a symlink to `target` at `dstPath`.
+func (s *snapshot) addSymlink(dstPath, target string) error {
+	path := snapshotFilePath(s.path+".partial", dstPath)
+	err := os.MkdirAll(filepath.Dir(path), os.ModeDir|os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Symlink(target, path)
+}
+
+// Creates a symlink to `target` at `dstPath`, replacing any file already there.
+func restoreSymlink(target, dstPath string) error {
+	err := os.MkdirAll(filepath.Dir(dstPath), os.ModeDir|os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = os.Lstat(dstPath)
+	if err == nil {
+		err = os.Remove(dstPath)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Symlink(target, dstPath)
+}
@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+)
+
+// Matches the names of tar.gz backups, including encrypted backups and volumes of split backups.
+var tarGzNameReg = regexp.MustCompile("\\.tar\\.gz(\\.enc)?(\\.\\d{3,})?$")
+
+// Returns the tar header for `info` stored as `dstPath`, preserving its mode and modification time.
+func tarHeader(info os.FileInfo, dstPath string) (*tar.Header, error) {
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return nil, err
+	}
+	header.Name = dstPath
+	// PAX headers store long names and sub-second modification times.
+	header.Format = tar.FormatPAX
+	return header, nil
+}
+
+// Writes `src` to a new tar entry and returns its size and hex encoded SHA-256.
+// Tar headers record the size before the contents, so if `src` is shorter than `info.Size()` or can't be read, the entry is padded with zeros and an error is returned.
+// `src` is read while holding `w.zipMu` because the whole stream is compressed, so concurrency only overlaps walking directories.
+func (w *walker) writeTar(dstPath string, info os.FileInfo, src io.Reader) (int64, string, error) {
+	header, err := tarHeader(info, dstPath)
+	if err != nil {
+		return 0, "", err
+	}
+	if w.zipMu != nil {
+		w.zipMu.Lock()
+		defer w.zipMu.Unlock()
+	}
+	start := w.gzipCounter.n
+	err = w.tar.WriteHeader(header)
+	if err != nil {
+		return 0, "", err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w.tar, hash), io.LimitReader(src, header.Size))
+	if err != nil {
+		// Finish the entry so later entries can still be written. The read error is more useful than any padding error.
+		io.CopyN(w.tar, zeroReader{}, header.Size-n)
+		return 0, "", err
+	}
+	// Estimated because gzip buffers its output.
+	w.compressedByteCount += w.gzipCounter.n - start
+	if n < header.Size {
+		_, err = io.CopyN(w.tar, zeroReader{}, header.Size-n)
+		if err != nil {
+			return 0, "", err
+		}
+		return 0, "", fmt.Errorf("File shrank from %d to %d bytes while being backed up.", header.Size, n)
+	}
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Adds the manifest to the tar. Must be called after all files have been added.
+func writeTarManifest(w *tar.Writer, m manifest) error {
+	manifestJSON, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     manifestName,
+		Size:     int64(len(manifestJSON)),
+		Mode:     0666,
+		ModTime:  m.Timestamp,
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(manifestJSON)
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,74 @@
+package backup
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Limits uploads to `bytesPerSecond` with a token bucket that holds at most a second of tokens.
+// Shared by every request of an upload so pauses between requests don't allow bursts. Not safe for concurrent use.
+type rateLimiter struct {
+	bytesPerSecond int64
+	tokens         float64
+	last           time.Time
+}
+
+// Returns nil, which doesn't limit, if `bytesPerSecond` is not positive.
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &rateLimiter{bytesPerSecond: bytesPerSecond, last: time.Now()}
+}
+
+// Returns a reader that reads from `r` no faster than the limit, or `r` itself if `l` is nil. Waiting stops when `ctx` is done.
+func (l *rateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, limiter: l}
+}
+
+// Waits until `n` bytes may be sent then takes their tokens. `n` must not exceed `bytesPerSecond`.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.bytesPerSecond)
+	if l.tokens > float64(l.bytesPerSecond) {
+		l.tokens = float64(l.bytesPerSecond)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return nil
+	}
+	// The deficit is repaid by the time the tokens refill.
+	timer := time.NewTimer(time.Duration(-l.tokens / float64(l.bytesPerSecond) * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.limiter.bytesPerSecond {
+		p = p[:t.limiter.bytesPerSecond]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		waitErr := t.limiter.wait(t.ctx, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
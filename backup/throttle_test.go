@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	const bytesPerSecond = 1 << 20
+	const n = bytesPerSecond / 2
+	l := newRateLimiter(bytesPerSecond)
+	start := time.Now()
+	copied, err := io.Copy(ioutil.Discard, l.reader(context.Background(), bytes.NewReader(make([]byte, n))))
+	elapsed := time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied != n {
+		t.Fatalf("Copied %d bytes, not %d.", copied, n)
+	}
+	// The bucket starts empty so every byte waits for its tokens.
+	want := time.Second / 2
+	if elapsed < want*9/10 || elapsed > want*2 {
+		t.Fatalf("Took %s to read %d bytes at %d bytes per second, want about %s.", elapsed, n, bytesPerSecond, want)
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	for _, bytesPerSecond := range []int64{0, -1} {
+		l := newRateLimiter(bytesPerSecond)
+		if l != nil {
+			t.Fatalf("Limiter for %d bytes per second isn't nil.", bytesPerSecond)
+		}
+		r := bytes.NewReader(make([]byte, 64<<20))
+		if l.reader(context.Background(), r) != io.Reader(r) {
+			t.Fatalf("Reader for %d bytes per second is throttled.", bytesPerSecond)
+		}
+		start := time.Now()
+		_, err := io.Copy(ioutil.Discard, l.reader(context.Background(), r))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Took %s to read 64 MiB without a limit.", elapsed)
+		}
+	}
+}
+
+func TestRateLimiterCancel(t *testing.T) {
+	l := newRateLimiter(1024)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := io.Copy(ioutil.Discard, l.reader(ctx, bytes.NewReader(make([]byte, 1<<20))))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Got %v, want %v.", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,321 @@
+package backup
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Checks `config` for every problem that would stop a backup or report from working, so they can all be fixed at once.
+func validate(config *Config) error {
+	problems := make([]string, 0)
+	problem := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	// Sources.
+	if len(config.Jobs) == 0 {
+		if len(config.Sources) == 0 {
+			problem("No sources are configured.")
+		}
+		validateSources(config.Sources, "", problem)
+	}
+	for _, job := range config.Jobs {
+		if len(job.Sources) == 0 {
+			problem("Job %q has no sources.", job.Name)
+		}
+		validateSources(job.Sources, fmt.Sprintf(" in job %q", job.Name), problem)
+		if job.RetentionCount < 0 {
+			problem("Invalid retentionCount %d for job %q. Must not be negative.", job.RetentionCount, job.Name)
+		}
+	}
+
+	// Destinations. Relative paths would depend on the working directory of the scheduled task.
+	dstDirPath, _ := filepath.Abs(config.DestinationDir)
+	destinations := map[string]bool{dstDirPath: true}
+	for _, destination := range config.Destinations {
+		if !filepath.IsAbs(destination) {
+			problem("Invalid destination %q. Must be an absolute path.", destination)
+			continue
+		}
+		if destinations[filepath.Clean(destination)] {
+			problem("Destination %q is used more than once. The destination directory given on the command line is always used.", destination)
+		}
+		destinations[filepath.Clean(destination)] = true
+	}
+
+	// Reports.
+	if config.SendGridEnable {
+		if config.SendGridAPIKey == "" {
+			problem("sendGridEnable is set but sendGridAPIKey is not.")
+		}
+		if config.SendGridFromAddress == "" {
+			problem("sendGridEnable is set but sendGridFromAddress is not.")
+		}
+	}
+	for _, endpoint := range []struct{ name, url string }{
+		{"sendGridEndpoint", config.SendGridEndpoint},
+		{"salesScribeEndpoint", config.SalesScribeEndpoint},
+		{"sesEndpoint", config.SESEndpoint},
+		{"mailgunEndpoint", config.MailgunEndpoint},
+	} {
+		if endpoint.url == "" {
+			continue
+		}
+		u, err := url.Parse(endpoint.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("Invalid %s %q. Must be an http or https URL.", endpoint.name, endpoint.url)
+		}
+	}
+	if config.SalesScribeEnable && config.SalesScribeAPIKey == "" {
+		problem("salesScribeEnable is set but salesScribeAPIKey is not.")
+	}
+	if config.SMTPEnable {
+		if config.SMTPHost == "" {
+			problem("smtpEnable is set but smtpHost is not.")
+		}
+		if config.SMTPFromAddress == "" {
+			problem("smtpEnable is set but smtpFromAddress is not.")
+		}
+	}
+	if config.SESEnable {
+		if config.SESRegion == "" {
+			problem("sesEnable is set but sesRegion is not.")
+		}
+		if config.SESFromAddress == "" {
+			problem("sesEnable is set but sesFromAddress is not.")
+		}
+		if (config.SESAccessKey == "") != (config.SESSecretKey == "") {
+			problem("sesAccessKey and sesSecretKey must be set together.")
+		}
+	}
+	if config.MailgunEnable {
+		if config.MailgunDomain == "" {
+			problem("mailgunEnable is set but mailgunDomain is not.")
+		}
+		if config.MailgunAPIKey == "" {
+			problem("mailgunEnable is set but mailgunAPIKey is not.")
+		}
+		if config.MailgunFromAddress == "" {
+			problem("mailgunEnable is set but mailgunFromAddress is not.")
+		}
+	}
+	if (config.SendGridEnable || config.SalesScribeEnable || config.SMTPEnable || config.SESEnable || config.MailgunEnable) && len(config.ErrorContacts) == 0 {
+		problem("Report emails are enabled but there are no errorContacts.")
+	}
+	for i, contact := range config.ErrorContacts {
+		if contact.Email == "" {
+			problem("Error contact %d has no email.", i+1)
+		}
+	}
+	for i, contact := range config.CCContacts {
+		if contact.Email == "" {
+			problem("CC contact %d has no email.", i+1)
+		}
+	}
+	for i, contact := range config.BCCContacts {
+		if contact.Email == "" {
+			problem("BCC contact %d has no email.", i+1)
+		}
+	}
+	if config.ReportReplyTo != "" {
+		_, err := mail.ParseAddress(config.ReportReplyTo)
+		if err != nil {
+			problem("Invalid reportReplyTo %q: %s.", config.ReportReplyTo, err)
+		}
+	}
+	if config.WebhookEnable && config.WebhookURL == "" {
+		problem("webhookEnable is set but webhookURL is not.")
+	}
+	if config.SlackEnable && config.SlackWebhookURL == "" {
+		problem("slackEnable is set but slackWebhookURL is not.")
+	}
+	if config.TeamsEnable && config.TeamsWebhookURL == "" {
+		problem("teamsEnable is set but teamsWebhookURL is not.")
+	}
+	if config.TelegramEnable && (config.TelegramBotToken == "" || config.TelegramChatID == "") {
+		problem("telegramEnable is set but telegramBotToken and telegramChatID are not both set.")
+	}
+	if config.DiscordEnable && config.DiscordWebhookURL == "" {
+		problem("discordEnable is set but discordWebhookURL is not.")
+	}
+
+	// Uploads.
+	if config.S3Enable {
+		if config.S3Bucket == "" || config.S3Region == "" || config.S3AccessKey == "" || config.S3SecretKey == "" {
+			problem("s3Enable is set but s3Bucket, s3Region, s3AccessKey and s3SecretKey are not all set.")
+		}
+	}
+	if config.B2Enable {
+		if config.B2Bucket == "" || config.B2KeyID == "" || config.B2ApplicationKey == "" {
+			problem("b2Enable is set but b2Bucket, b2KeyID and b2ApplicationKey are not all set.")
+		}
+	}
+	if config.SFTPEnable {
+		if config.SFTPHost == "" || config.SFTPUsername == "" || config.SFTPKnownHostsPath == "" {
+			problem("sftpEnable is set but sftpHost, sftpUsername and sftpKnownHostsPath are not all set.")
+		}
+		if config.SFTPKeyPath == "" && config.SFTPPassword == "" {
+			problem("sftpEnable is set but neither sftpKeyPath nor sftpPassword is.")
+		}
+	}
+
+	// Directory backups are plain files so they can't be encrypted, split, uploaded or incremental.
+	switch config.BackupFormat {
+	case "", "zip":
+	case "directory":
+		if config.EncryptionPassword != "" || config.EncryptionPasswordEnv != "" {
+			problem("backupFormat \"directory\" does not support encryption.")
+		}
+		if config.SplitBytes > 0 {
+			problem("backupFormat \"directory\" does not support splitBytes.")
+		}
+		if config.Incremental {
+			problem("backupFormat \"directory\" does not support incremental backups. Unchanged files are linked instead.")
+		}
+		if config.S3Enable || config.B2Enable || config.SFTPEnable {
+			problem("backupFormat \"directory\" does not support uploads.")
+		}
+	default:
+		problem("Invalid backupFormat %q. Must be \"zip\" or \"directory\".", config.BackupFormat)
+	}
+	switch config.ArchiveFormat {
+	case "", "zip":
+	case "targz":
+		if config.BackupFormat == "directory" {
+			problem("archiveFormat \"targz\" can't be used with backupFormat \"directory\".")
+		}
+	default:
+		problem("Invalid archiveFormat %q. Must be \"zip\" or \"targz\".", config.ArchiveFormat)
+	}
+
+	// Ranges.
+	if config.FileReadRetries < 0 {
+		problem("Invalid fileReadRetries %d. Must not be negative.", config.FileReadRetries)
+	}
+	if config.RetentionCount < 0 {
+		problem("Invalid retentionCount %d. Must not be negative.", config.RetentionCount)
+	}
+	if config.Retention.Daily < 0 || config.Retention.Weekly < 0 || config.Retention.Monthly < 0 {
+		problem("Invalid retention %+v. Counts must not be negative.", config.Retention)
+	}
+	if config.MaxAgeDays < 0 {
+		problem("Invalid maxAgeDays %d. Must not be negative.", config.MaxAgeDays)
+	}
+	if config.MaxTotalBytes < 0 {
+		problem("Invalid maxTotalBytes %d. Must not be negative.", config.MaxTotalBytes)
+	}
+	if config.MinIntervalHours < 0 {
+		problem("Invalid minIntervalHours %d. Must not be negative.", config.MinIntervalHours)
+	}
+	if config.MaxFileBytes < 0 {
+		problem("Invalid maxFileBytes %d. Must not be negative.", config.MaxFileBytes)
+	}
+	if config.ExcludeModifiedWithinSeconds < 0 {
+		problem("Invalid excludeModifiedWithinSeconds %d. Must not be negative.", config.ExcludeModifiedWithinSeconds)
+	}
+	if config.ExcludeOlderThanDays < 0 {
+		problem("Invalid excludeOlderThanDays %d. Must not be negative.", config.ExcludeOlderThanDays)
+	}
+	if config.MinFreeBytes < 0 {
+		problem("Invalid minFreeBytes %d. Must not be negative.", config.MinFreeBytes)
+	}
+	if config.CompressionThreads < 0 {
+		problem("Invalid compressionThreads %d. Must not be negative.", config.CompressionThreads)
+	}
+	if config.MaxErrors < 0 {
+		problem("Invalid maxErrors %d. Must not be negative.", config.MaxErrors)
+	}
+	if config.SplitBytes < 0 {
+		problem("Invalid splitBytes %d. Must not be negative.", config.SplitBytes)
+	}
+	if config.UploadMaxBytesPerSecond < 0 {
+		problem("Invalid uploadMaxBytesPerSecond %d. Must not be negative.", config.UploadMaxBytesPerSecond)
+	}
+	if config.ReportTimeoutSeconds < 0 {
+		problem("Invalid reportTimeoutSeconds %d. Must not be negative.", config.ReportTimeoutSeconds)
+	}
+	// The wait between attempts doubles, so more retries would wait for days.
+	if config.ReportMaxRetries < 0 || config.ReportMaxRetries > 10 {
+		problem("Invalid reportMaxRetries %d. Must be between 0 and 10.", config.ReportMaxRetries)
+	}
+	if config.ReportMaxErrorsInBody < 0 {
+		problem("Invalid reportMaxErrorsInBody %d. Must not be negative.", config.ReportMaxErrorsInBody)
+	}
+	if config.ReportProxyURL != "" {
+		proxyURL, err := url.Parse(config.ReportProxyURL)
+		if err != nil || (proxyURL.Scheme != "http" && proxyURL.Scheme != "https" && proxyURL.Scheme != "socks5") || proxyURL.Host == "" {
+			problem("Invalid reportProxyURL %q. Must be an http, https or socks5 URL with a host.", redactURL(config.ReportProxyURL))
+		}
+	}
+	if config.AttachLogMaxBytes < 0 {
+		problem("Invalid attachLogMaxBytes %d. Must not be negative.", config.AttachLogMaxBytes)
+	}
+	if config.Concurrency < 0 {
+		problem("Invalid concurrency %d. Must not be negative.", config.Concurrency)
+	}
+	if config.SortEntries && config.Concurrency > 1 {
+		problem("sortEntries can't be used with a concurrency above 1 because the entries of sources backed up at the same time are interleaved.")
+	}
+	if config.FreeSpaceSafetyFactor < 0 {
+		problem("Invalid freeSpaceSafetyFactor %g. Must not be negative.", config.FreeSpaceSafetyFactor)
+	}
+	if config.FullBackupIntervalDays < 0 {
+		problem("Invalid fullBackupIntervalDays %d. Must not be negative.", config.FullBackupIntervalDays)
+	}
+	if config.NoCompression && config.CompressionLevel != nil && *config.CompressionLevel != flate.NoCompression {
+		problem("noCompression can't be used with a compressionLevel other than 0.")
+	}
+	if config.CompressionLevel != nil && (*config.CompressionLevel < flate.HuffmanOnly || *config.CompressionLevel > flate.BestCompression) {
+		problem("Invalid compressionLevel %d. Must be between %d and %d.", *config.CompressionLevel, flate.HuffmanOnly, flate.BestCompression)
+	}
+	if !regexp.MustCompile("^[A-Za-z0-9-]*$").MatchString(config.NamePrefix) {
+		problem("Invalid namePrefix %q. Must only contain letters, digits and hyphens.", config.NamePrefix)
+	}
+	_, err := backupName(config, time.Now())
+	if err != nil {
+		problem("%s", err)
+	}
+	if config.Timezone != "" {
+		_, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			problem("Invalid timezone %q: %s.", config.Timezone, err)
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New("Invalid config:\n- " + strings.Join(problems, "\n- "))
+}
+
+func validateSources(sources []Source, where string, problem func(string, ...interface{})) {
+	for i, source := range sources {
+		if source.Path == "" {
+			problem("Source %d%s has no path.", i+1, where)
+		}
+		for _, raw := range append(append([]string{}, source.Blacklist...), source.Whitelist...) {
+			err := checkPattern(raw)
+			if err != nil {
+				problem("%s in source %q%s.", err, source.Path, where)
+			}
+		}
+		for _, raw := range source.Whitelist {
+			if strings.HasSuffix(filepath.ToSlash(raw), "/") {
+				problem("Whitelist pattern %q in source %q%s only matches directories, but only files are whitelisted.", raw, source.Path, where)
+			}
+		}
+		if source.MaxFileBytes < 0 {
+			problem("Invalid maxFileBytes %d for source %q%s. Must not be negative.", source.MaxFileBytes, source.Path, where)
+		}
+		if source.ExcludeOlderThanDays < 0 {
+			problem("Invalid excludeOlderThanDays %d for source %q%s. Must not be negative.", source.ExcludeOlderThanDays, source.Path, where)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+)
+
+// Verify checks the backup at `backupPath` against its manifest and returns every discrepancy or error.
+// Zip and tar.gz backups are told apart by their names. `password` is only required for encrypted backups. `logger` may be nil.
+func Verify(backupPath, password string, logger *log.Logger) []error {
+	e := newErrorHandler(logger)
+	e.catch(func() {
+		verify(e, backupPath, password)
+	})
+	return e.errs
+}
+
+// The size and checksum of a backed up file, or the error reading it.
+type entryHash struct {
+	size int64
+	sum  string
+	err  error
+}
+
+// Checks every file in the backup at `backupPath` against the checksums in its manifest.
+// Discrepancies are recorded as errors. `password` is only required for encrypted backups.
+func verify(e *errorHandler, backupPath, password string) {
+	a, closeBackup, err := openBackup(backupPath, password)
+	e.panicIfErr(err)
+	defer closeBackup()
+
+	// Hash every file in one pass because tar.gz backups can only be read in order. The manifest is the last entry.
+	var m *manifest
+	hashes := make(map[string]entryHash)
+	names := make([]string, 0)
+	err = a.walk(func(entry archiveEntry) error {
+		// Directories and symlinks aren't in the manifest.
+		if entry.isDir || entry.linkTarget != "" {
+			return nil
+		}
+		if entry.name == manifestName {
+			manifestReader, err := entry.open()
+			if err != nil {
+				return err
+			}
+			manifestJSON, err := ioutil.ReadAll(manifestReader)
+			manifestReader.Close()
+			if err != nil {
+				return err
+			}
+			m = &manifest{}
+			return json.Unmarshal(manifestJSON, m)
+		}
+		size, sum, err := hashEntry(entry)
+		hashes[entry.name] = entryHash{size: size, sum: sum, err: err}
+		names = append(names, entry.name)
+		return nil
+	})
+	e.panicIfErr(err)
+	if m == nil {
+		e.print(errors.New("Backup has no manifest. It was probably created before manifests were added."))
+		return
+	}
+
+	// Check files listed in the manifest.
+	listed := make(map[string]bool)
+	for _, mf := range m.Files {
+		listed[mf.Path] = true
+		h, ok := hashes[mf.Path]
+		if !ok {
+			e.print(fmt.Errorf("%q is in the manifest but missing from the backup.", mf.Path))
+			continue
+		}
+		if h.err != nil {
+			e.print(fmt.Errorf("Unable to read %q: %w", mf.Path, h.err))
+			continue
+		}
+		if h.size != mf.Size {
+			e.print(fmt.Errorf("%q is %d bytes but the manifest records %d bytes.", mf.Path, h.size, mf.Size))
+		}
+		if h.sum != mf.SHA256 {
+			e.print(fmt.Errorf("%q has SHA-256 %s but the manifest records %s.", mf.Path, h.sum, mf.SHA256))
+		}
+	}
+
+	// Check for files not listed in the manifest.
+	for _, name := range names {
+		if listed[name] {
+			continue
+		}
+		e.print(fmt.Errorf("%q is in the backup but not in the manifest.", name))
+	}
+
+	if len(e.errs) == 0 {
+		e.logger.Printf("Verified %d files from %s.", len(m.Files), m.Timestamp)
+	}
+}
+
+// Returns the size and hex encoded SHA-256 of an entry's contents.
+func hashEntry(entry archiveEntry) (int64, string, error) {
+	src, err := entry.open()
+	if err != nil {
+		return 0, "", err
+	}
+	defer src.Close()
+	hash := sha256.New()
+	n, err := io.Copy(hash, src)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
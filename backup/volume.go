@@ -0,0 +1,213 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Writes a backup to `<path>.partial`, or to `<path>.001.partial`, `<path>.002.partial` etc. of at most `splitBytes` each if `splitBytes` is positive.
+// The files are only given their final names by `commit` so a failed backup is never mistaken for a good one.
+type volumeWriter struct {
+	path       string
+	splitBytes int64
+	file       *os.File // The volume being written. nil before the first write and after closing.
+	written    int64    // Bytes written to `file`.
+	paths      []string // Final paths of every volume created so far.
+	hash       hash.Hash
+	sums       []string // Hex encoded SHA-256 of every closed volume.
+}
+
+func newVolumeWriter(path string, splitBytes int64) *volumeWriter {
+	return &volumeWriter{path: path, splitBytes: splitBytes, hash: sha256.New()}
+}
+
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if v.file == nil || (v.splitBytes > 0 && v.written == v.splitBytes) {
+			err := v.next()
+			if err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if v.splitBytes > 0 && int64(len(chunk)) > v.splitBytes-v.written {
+			chunk = chunk[:v.splitBytes-v.written]
+		}
+		written, err := v.file.Write(chunk)
+		v.hash.Write(chunk[:written])
+		n += written
+		v.written += int64(written)
+		if err != nil {
+			return n, err
+		}
+		p = p[written:]
+	}
+	return n, nil
+}
+
+// Closes the current volume and creates the next.
+func (v *volumeWriter) next() error {
+	if v.file != nil {
+		err := v.closeFile()
+		if err != nil {
+			return err
+		}
+	}
+	path := v.path
+	if v.splitBytes > 0 {
+		path = fmt.Sprintf("%s.%03d", v.path, len(v.paths)+1)
+	}
+	file, err := os.Create(path + ".partial")
+	if err != nil {
+		return err
+	}
+	v.file = file
+	v.written = 0
+	v.paths = append(v.paths, path)
+	return nil
+}
+
+// Closes the current volume. Creates an empty volume if nothing was written.
+func (v *volumeWriter) Close() error {
+	if v.file == nil && len(v.paths) == 0 {
+		err := v.next()
+		if err != nil {
+			return err
+		}
+	}
+	if v.file == nil {
+		return nil
+	}
+	return v.closeFile()
+}
+
+// Closes the current volume and records its checksum.
+func (v *volumeWriter) closeFile() error {
+	err := v.file.Close()
+	v.file = nil
+	v.sums = append(v.sums, hex.EncodeToString(v.hash.Sum(nil)))
+	v.hash.Reset()
+	return err
+}
+
+// Renames every volume to its final name and returns their paths in order. Must be called after `Close`.
+func (v *volumeWriter) commit() ([]string, error) {
+	for _, path := range v.paths {
+		err := os.Rename(path+".partial", path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return v.paths, nil
+}
+
+// Deletes every volume that hasn't been committed.
+func (v *volumeWriter) remove() {
+	if v.file != nil {
+		v.file.Close()
+		v.file = nil
+	}
+	for _, path := range v.paths {
+		os.Remove(path + ".partial")
+	}
+}
+
+// Reads the volumes of a backup as if they were one file.
+type volumeReader struct {
+	files []*os.File
+	sizes []int64
+	size  int64
+}
+
+// Opens the backup at `path`. If `path` ends in `.001`, or doesn't exist but `<path>.001` does, every following volume is opened too.
+func openVolumes(path string) (*volumeReader, error) {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		_, splitErr := os.Stat(path + ".001")
+		if splitErr == nil {
+			path += ".001"
+		}
+	}
+
+	paths := []string{path}
+	if strings.HasSuffix(path, ".001") {
+		base := strings.TrimSuffix(path, ".001")
+		for i := 2; ; i++ {
+			volumePath := fmt.Sprintf("%s.%03d", base, i)
+			_, err := os.Stat(volumePath)
+			if os.IsNotExist(err) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, volumePath)
+		}
+	}
+
+	v := &volumeReader{}
+	for _, volumePath := range paths {
+		file, err := os.Open(volumePath)
+		if err != nil {
+			v.Close()
+			return nil, err
+		}
+		v.files = append(v.files, file)
+		info, err := file.Stat()
+		if err != nil {
+			v.Close()
+			return nil, err
+		}
+		v.sizes = append(v.sizes, info.Size())
+		v.size += info.Size()
+	}
+	return v, nil
+}
+
+func (v *volumeReader) ReadAt(p []byte, off int64) (int, error) {
+	var n int
+	for i, file := range v.files {
+		if len(p) == 0 {
+			break
+		}
+		if off >= v.sizes[i] {
+			off -= v.sizes[i]
+			continue
+		}
+		chunk := p
+		if int64(len(chunk)) > v.sizes[i]-off {
+			chunk = chunk[:v.sizes[i]-off]
+		}
+		read, err := file.ReadAt(chunk, off)
+		n += read
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if read < len(chunk) {
+			return n, io.ErrUnexpectedEOF
+		}
+		p = p[read:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (v *volumeReader) Close() error {
+	var firstErr error
+	for _, file := range v.files {
+		err := file.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,67 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// A Volume Shadow Copy Service snapshot of a volume.
+type shadowCopy struct {
+	id         string
+	volume     string // e.g. "C:"
+	devicePath string // e.g. "\\?\GLOBALROOT\Device\HarddiskVolumeShadowCopy1"
+}
+
+// Returns the path within the snapshot equivalent to `p`, which must be on the snapshot's volume.
+func (s *shadowCopy) path(p string) string {
+	return s.devicePath + p[len(s.volume):]
+}
+
+// Snapshots the volumes of `sources` and returns copies of them that read from the snapshots.
+// Sources whose volume cannot be snapshotted are read directly.
+// The returned function deletes the snapshots and must be called once the sources have been read.
+func shadowSources(e *errorHandler, sources []Source) ([]Source, func()) {
+	shadowCopies := make(map[string]*shadowCopy)
+	shadowedSources := make([]Source, len(sources))
+	for i, source := range sources {
+		shadowedSources[i] = source
+		absPath, err := filepath.Abs(source.Path)
+		if err != nil {
+			e.warn(fmt.Sprintf("Unable to use VSS for %q. Reading directly: %s", source.Path, err))
+			continue
+		}
+		volume := strings.ToUpper(filepath.VolumeName(absPath))
+		if len(volume) != 2 || volume[1] != ':' {
+			e.warn(fmt.Sprintf("Unable to use VSS for %q. Reading directly: Only drive letter volumes can be snapshotted.", source.Path))
+			continue
+		}
+		s, ok := shadowCopies[volume]
+		if !ok {
+			e.logger.Printf("Creating VSS snapshot of %s", volume)
+			s, err = createShadowCopy(volume)
+			if err != nil {
+				e.warn(fmt.Sprintf("Unable to create VSS snapshot of %s. Reading directly: %s", volume, err))
+			}
+			// Store failures too so they are not retried for every source on the volume.
+			shadowCopies[volume] = s
+		}
+		if s != nil {
+			shadowedSources[i].Path = s.path(absPath)
+		}
+	}
+
+	deleteShadowCopies := func() {
+		for volume, s := range shadowCopies {
+			if s == nil {
+				continue
+			}
+			e.logger.Printf("Deleting VSS snapshot of %s", volume)
+			err := s.delete()
+			if err != nil {
+				e.print(fmt.Errorf("Unable to delete VSS snapshot %s of %s: %w", s.id, volume, err))
+			}
+		}
+	}
+	return shadowedSources, deleteShadowCopies
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package backup
+
+import "errors"
+
+func createShadowCopy(volume string) (*shadowCopy, error) {
+	return nil, errors.New("VSS is only available on Windows.")
+}
+
+func (s *shadowCopy) delete() error {
+	return nil
+}
@@ -0,0 +1,48 @@
+//go:build windows
+
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Creates a snapshot of `volume` (e.g. "C:") using PowerShell and WMI. Requires administrator privileges.
+func createShadowCopy(volume string) (*shadowCopy, error) {
+	script := `$ErrorActionPreference = 'Stop'
+$result = (Get-WmiObject -List Win32_ShadowCopy).Create('` + volume + `\', 'ClientAccessible')
+if ($result.ReturnValue -ne 0) { throw "Win32_ShadowCopy.Create returned $($result.ReturnValue)" }
+$shadow = Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq $result.ShadowID }
+Write-Output "$($shadow.ID)|$($shadow.DeviceObject)"`
+	output, err := powerShell(script)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.TrimSpace(output), "|", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Unexpected output from PowerShell: %q", output)
+	}
+	return &shadowCopy{
+		id:         parts[0],
+		volume:     volume,
+		devicePath: parts[1],
+	}, nil
+}
+
+func (s *shadowCopy) delete() error {
+	script := `$ErrorActionPreference = 'Stop'
+Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq '` + s.id + `' } | ForEach-Object { $_.Delete() }`
+	_, err := powerShell(script)
+	return err
+}
+
+func powerShell(script string) (string, error) {
+	cmd := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("PowerShell failed: %s: %s", err, strings.TrimSpace(string(output))))
+	}
+	return string(output), nil
+}
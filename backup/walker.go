@@ -0,0 +1,423 @@
+package backup
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Walks a source and adds its files to a zip, tar.gz or directory backup.
+type walker struct {
+	zip    *zip.Writer // nil when only counting what would be backed up or when backing up to `snapshot` or `tar`.
+	dryRun bool        // Log what would be backed up. Only used when counting.
+	since  time.Time   // Only files modified after this are backed up. Zero for full backups.
+	oldest time.Time   // Files modified before this are skipped. Zero to back up files of any age.
+	// The directory backup being written instead of a zip. nil for zip backups.
+	snapshot *snapshot
+	// Guards `zip` or `tar` when several walkers share it. Files are compressed before locking so walkers run in parallel.
+	zipMu  *sync.Mutex
+	e      *errorHandler
+	config *Config
+	source Source
+	// The source's patterns, prepared once rather than for every path.
+	blacklist []pattern
+	whitelist []pattern
+	// Ignore files of the directory being walked and its parents, outermost first.
+	ignores []*ignoreFile
+	// Counts what has been backed up. nil when progress isn't logged.
+	progress *progress
+	// Called for each error as it occurs, so the walk can be stopped before it finishes. Optional.
+	onError func()
+	// Real paths of directories already walked so symlink loops are not followed forever.
+	visited       map[string]bool
+	fileCount     int
+	dirCount      int
+	byteCount     int64
+	manifestFiles []manifestFile
+	// Compressed size of the files, excluding `lastHeader`. For directory backups, the size of the files copied rather than linked. Estimated for tar.gz backups.
+	compressedByteCount int64
+	// Files hard linked to the previous directory backup.
+	linkedCount int
+	// Files skipped because they were modified within `config.ExcludeModifiedWithinSeconds`.
+	deferredCount int
+	// The latest entry written by `write`. Its compressed size is only set once the zip writer moves on to the next entry.
+	lastHeader *zip.FileHeader
+	// The tar.gz backup being written instead of a zip. nil for other formats.
+	tar *tar.Writer
+	// Counts the compressed output of `tar` so each source's share can be estimated.
+	gzipCounter *countingWriter
+}
+
+func newWalker(w *zip.Writer, e *errorHandler, config *Config, source Source) *walker {
+	walker := &walker{
+		zip:       w,
+		e:         e,
+		config:    config,
+		source:    source,
+		blacklist: compilePatterns(source.Blacklist, !config.CaseSensitiveMatch),
+		whitelist: compilePatterns(source.Whitelist, !config.CaseSensitiveMatch),
+		visited:   make(map[string]bool),
+	}
+	excludeOlderThanDays := config.ExcludeOlderThanDays
+	if source.ExcludeOlderThanDays != 0 {
+		excludeOlderThanDays = source.ExcludeOlderThanDays
+	}
+	if excludeOlderThanDays > 0 {
+		walker.oldest = time.Now().Add(-time.Duration(excludeOlderThanDays) * 24 * time.Hour)
+	}
+	return walker
+}
+
+// Logs a problem with the source. Estimates are silent because the problem will be logged again when backing up.
+func (w *walker) warn(message string) {
+	if !w.counting() || w.dryRun {
+		w.e.warn(message)
+	}
+}
+
+// Returns true when only counting what would be backed up.
+func (w *walker) counting() bool {
+	return w.zip == nil && w.tar == nil && w.snapshot == nil
+}
+
+// Returns `err` from backing up `srcPath` to be added to the errors of the walk, first counting it with `onError` if set.
+// Errors within the source are wrapped in `skippedPathError` because the rest of the source is still backed up.
+func (w *walker) fail(srcPath string, err error) []error {
+	if w.onError != nil {
+		w.onError()
+	}
+	if srcPath != w.source.Path {
+		err = skippedPathError{err}
+	}
+	return []error{err}
+}
+
+// An error backing up a file or directory within a source, which only leaves that path out of the backup.
+type skippedPathError struct {
+	err error
+}
+
+func (s skippedPathError) Error() string {
+	return s.err.Error()
+}
+
+func (s skippedPathError) Unwrap() error {
+	return s.err
+}
+
+func (w *walker) dryRunf(format string, v ...interface{}) {
+	if w.dryRun {
+		w.e.logger.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+// Logs a file or directory added or skipped while backing up if `config.Verbose` is set. Estimates are silent.
+func (w *walker) verbosef(format string, v ...interface{}) {
+	if w.config.Verbose && !w.counting() {
+		w.e.logger.Output(2, fmt.Sprintf(format, v...))
+	}
+}
+
+// Backs up everything in `srcPath`. Stops early once `ctx` is done.
+func (w *walker) addSrc(ctx context.Context, srcPath, dstPath string) []error {
+	err := ctx.Err()
+	if err != nil {
+		return []error{err}
+	}
+	// Directory only patterns are checked once the path is known to be a directory, so other blacklisted paths are skipped without reading them.
+	blacklisted, err := w.firstMatch(w.blacklist, srcPath, false)
+	if err != nil {
+		return w.fail(srcPath, err)
+	}
+	if blacklisted != nil {
+		w.dryRunf("Would skip %q (blacklisted by %q)", srcPath, blacklisted.raw)
+		w.verbosef("Skipped %q (blacklisted by %q)", srcPath, blacklisted.raw)
+		return []error{}
+	}
+	info, err := os.Lstat(srcPath)
+	if err != nil {
+		return w.fail(srcPath, err)
+	}
+	// Symlinks are stored as links unless they are followed. The source path itself is always followed.
+	link := info.Mode()&os.ModeSymlink != 0 && !w.source.followSymlinks() && srcPath != w.source.Path
+	if info.Mode()&os.ModeSymlink != 0 && !link {
+		info, err = os.Stat(srcPath)
+		if err != nil {
+			return w.fail(srcPath, err)
+		}
+	}
+	if info.IsDir() {
+		blacklisted, err := w.firstMatch(w.blacklist, srcPath, true)
+		if err != nil {
+			return w.fail(srcPath, err)
+		}
+		if blacklisted != nil {
+			w.dryRunf("Would skip %q (blacklisted by %q)", srcPath, blacklisted.raw)
+			w.verbosef("Skipped %q (blacklisted by %q)", srcPath, blacklisted.raw)
+			return []error{}
+		}
+	}
+	if len(w.ignores) > 0 {
+		ignoredBy, err := w.ignoredBy(srcPath, info.IsDir())
+		if err != nil {
+			return w.fail(srcPath, err)
+		}
+		if ignoredBy != "" {
+			w.dryRunf("Would skip %q (ignored by %s)", srcPath, ignoredBy)
+			w.verbosef("Skipped %q (ignored by %s)", srcPath, ignoredBy)
+			return []error{}
+		}
+	}
+	if info.IsDir() {
+		realPath, err := filepath.EvalSymlinks(srcPath)
+		if err != nil {
+			return w.fail(srcPath, err)
+		}
+		if w.visited[realPath] {
+			w.warn(fmt.Sprintf("Skipping %q because %q has already been backed up. This is probably a symlink loop.", srcPath, realPath))
+			return []error{}
+		}
+		w.visited[realPath] = true
+		var infos []os.FileInfo
+		err = w.retry(ctx, srcPath, func() error {
+			infos, err = ioutil.ReadDir(srcPath)
+			return err
+		})
+		if err != nil {
+			return w.fail(srcPath, err)
+		}
+		if w.config.SortEntries {
+			sortByEntryName(infos, srcPath, w.source.followSymlinks())
+		}
+		if w.config.BackupIgnoreFiles {
+			ignoreFile, err := readIgnoreFile(srcPath, !w.config.CaseSensitiveMatch)
+			if err != nil {
+				return w.fail(srcPath, err)
+			}
+			// The rules apply to everything within this directory.
+			if ignoreFile != nil {
+				w.ignores = append(w.ignores, ignoreFile)
+				defer func() {
+					w.ignores = w.ignores[:len(w.ignores)-1]
+				}()
+			}
+		}
+		errs := make([]error, 0)
+		entryCount := w.fileCount + w.dirCount
+		for _, info := range infos {
+			name := info.Name()
+			childSrcPath := filepath.Join(srcPath, name)
+			// Zip entries always use forward slashes.
+			childDstPath := path.Join(dstPath, name)
+			childErrs := w.addSrc(ctx, childSrcPath, childDstPath)
+			for _, err := range childErrs {
+				errs = append(errs, err)
+			}
+			if ctx.Err() != nil {
+				return errs
+			}
+		}
+		// Directories are implied by the files within them so only empty directories need entries.
+		// Incremental backups skip unchanged files so directories only appear empty.
+		if w.config.IncludeEmptyDirs && w.since.IsZero() && w.fileCount+w.dirCount == entryCount {
+			w.dirCount++
+			if w.counting() {
+				w.dryRunf("Would add empty directory %q", srcPath)
+				return errs
+			}
+			if w.snapshot != nil {
+				err := w.snapshot.addDir(dstPath)
+				if err != nil {
+					return append(errs, w.fail(srcPath, err)...)
+				}
+				w.verbosef("Added empty directory %q", srcPath)
+				return errs
+			}
+			if w.zipMu != nil {
+				w.zipMu.Lock()
+			}
+			var err error
+			if w.tar != nil {
+				var header *tar.Header
+				header, err = tarHeader(info, dstPath+"/")
+				if err == nil {
+					err = w.tar.WriteHeader(header)
+				}
+			} else {
+				_, err = w.zip.CreateHeader(&zip.FileHeader{
+					Name:          dstPath + "/",
+					Modified:      info.ModTime(),
+					ExternalAttrs: fileAttributes(info) | dosDirectory,
+				})
+			}
+			if w.zipMu != nil {
+				w.zipMu.Unlock()
+			}
+			if err != nil {
+				errs = append(errs, w.fail(srcPath, err)...)
+			} else {
+				w.verbosef("Added empty directory %q", srcPath)
+			}
+		}
+		return errs
+	} else {
+		if len(w.whitelist) > 0 {
+			whitelisted, err := w.firstMatch(w.whitelist, srcPath, false)
+			if err != nil {
+				return w.fail(srcPath, err)
+			}
+			if whitelisted == nil {
+				w.dryRunf("Would skip %q (not whitelisted)", srcPath)
+				w.verbosef("Skipped %q (not whitelisted)", srcPath)
+				return []error{}
+			}
+		}
+		if !w.since.IsZero() && !info.ModTime().After(w.since) {
+			w.dryRunf("Would skip %q (not modified since the last backup)", srcPath)
+			w.verbosef("Skipped %q (not modified since the last backup)", srcPath)
+			return []error{}
+		}
+		if w.config.ExcludeModifiedWithinSeconds > 0 && time.Since(info.ModTime()) < time.Duration(w.config.ExcludeModifiedWithinSeconds)*time.Second {
+			w.deferredCount++
+			w.dryRunf("Would skip %q (modified within excludeModifiedWithinSeconds)", srcPath)
+			w.verbosef("Skipped %q (modified within excludeModifiedWithinSeconds)", srcPath)
+			return []error{}
+		}
+		if !w.oldest.IsZero() && info.ModTime().Before(w.oldest) {
+			w.dryRunf("Would skip %q (last modified before the excludeOlderThanDays cutoff)", srcPath)
+			w.verbosef("Skipped %q (last modified before the excludeOlderThanDays cutoff)", srcPath)
+			return []error{}
+		}
+		maxFileBytes := w.config.MaxFileBytes
+		if w.source.MaxFileBytes != 0 {
+			maxFileBytes = w.source.MaxFileBytes
+		}
+		if maxFileBytes > 0 && info.Size() > maxFileBytes {
+			w.warn(fmt.Sprintf("Skipping %q because it is %d bytes, which is more than maxFileBytes %d.", srcPath, info.Size(), maxFileBytes))
+			return []error{}
+		}
+		if link {
+			return w.addSymlink(srcPath, dstPath, info)
+		}
+		if w.counting() {
+			w.dryRunf("Would add %q (%d bytes)", srcPath, info.Size())
+			w.fileCount++
+			w.byteCount += info.Size()
+			return []error{}
+		}
+		src, err := w.openFile(ctx, srcPath)
+		if err != nil {
+			if w.config.SkipLockedFiles && isLocked(err) {
+				w.warn(fmt.Sprintf("Skipping locked file: %s", err))
+				return []error{}
+			}
+			return w.fail(srcPath, err)
+		}
+		defer src.Close()
+		// Use a header rather than `w.zip.Create` so the modification time and attributes are preserved.
+		header := &zip.FileHeader{
+			Name:          dstPath,
+			Method:        compressionMethod(w.config),
+			Modified:      info.ModTime(),
+			ExternalAttrs: fileAttributes(info),
+		}
+		var n int64
+		var sum string
+		// Check for cancellation while copying so large files don't delay it.
+		var ctxSrc io.Reader = &contextReader{ctx: ctx, r: src}
+		if w.progress != nil {
+			ctxSrc = &progressReader{p: w.progress, r: ctxSrc}
+		}
+		var linked bool
+		if w.snapshot != nil {
+			n, sum, linked, err = w.snapshot.add(ctx, dstPath, info, src, ctxSrc)
+		} else if w.tar != nil {
+			n, sum, err = w.writeTar(dstPath, info, ctxSrc)
+		} else if w.zipMu != nil {
+			n, sum, err = w.writeSpooled(header, ctxSrc)
+		} else {
+			n, sum, err = w.write(header, ctxSrc)
+		}
+		if err != nil {
+			return w.fail(srcPath, err)
+		}
+		w.fileCount++
+		w.byteCount += n
+		if w.progress != nil {
+			w.progress.files.Add(1)
+		}
+		if linked {
+			w.linkedCount++
+			w.verbosef("Linked %q (%d bytes) to the previous backup", srcPath, n)
+		} else {
+			if w.snapshot != nil {
+				w.compressedByteCount += n
+			}
+			w.verbosef("Added %q (%d bytes)", srcPath, n)
+		}
+		w.manifestFiles = append(w.manifestFiles, manifestFile{
+			Path:   dstPath,
+			Size:   n,
+			SHA256: sum,
+		})
+	}
+	return []error{}
+}
+
+// Sorts the entries of the directory at `dirPath` so walking them adds entries in byte order of their full paths.
+// `ioutil.ReadDir` sorts by name, which puts "a/b" before "a.txt" because "a" comes before "a.txt", so directories are sorted as if their names ended with "/".
+// Symlinks to directories only count as directories when they are followed.
+func sortByEntryName(infos []os.FileInfo, dirPath string, followSymlinks bool) {
+	keys := make(map[string]string, len(infos))
+	for _, info := range infos {
+		isDir := info.IsDir()
+		if info.Mode()&os.ModeSymlink != 0 && followSymlinks {
+			target, err := os.Stat(filepath.Join(dirPath, info.Name()))
+			isDir = err == nil && target.IsDir()
+		}
+		keys[info.Name()] = info.Name()
+		if isDir {
+			keys[info.Name()] += "/"
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return keys[infos[i].Name()] < keys[infos[j].Name()]
+	})
+}
+
+// Writes `src` to a new zip entry and returns its size and hex encoded SHA-256.
+func (w *walker) write(header *zip.FileHeader, src io.Reader) (int64, string, error) {
+	dst, err := w.zip.CreateHeader(header)
+	if err != nil {
+		return 0, "", err
+	}
+	if w.lastHeader != nil {
+		w.compressedByteCount += int64(w.lastHeader.CompressedSize64)
+	}
+	w.lastHeader = header
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Returns the compressed size of the files backed up, excluding zip headers. Only complete once the zip has been closed.
+func (w *walker) compressedBytes() int64 {
+	if w.lastHeader == nil {
+		return w.compressedByteCount
+	}
+	return w.compressedByteCount + int64(w.lastHeader.CompressedSize64)
+}
@@ -0,0 +1,112 @@
+package backup
+
+import (
+	"archive/zip"
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Backs up `config` to a new destination directory and returns the names of the entries in the zip, in order.
+func zipEntryNames(t *testing.T, config Config) []string {
+	t.Helper()
+	config.DestinationDir = t.TempDir()
+	result, err := Run(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Errors) > 0 {
+		t.Fatal(result.Errors)
+	}
+	r, err := zip.OpenReader(result.ArchivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	names := make([]string, 0, len(r.File))
+	for _, file := range r.File {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func TestSortEntriesIsDeterministic(t *testing.T) {
+	srcPath := filepath.Join(t.TempDir(), "src")
+	// Names that `ioutil.ReadDir` orders differently to their full paths.
+	for _, path := range []string{"a/b", "a.txt", "a-c", "B/x", "Z", "z", "a/b.d/e", "a/b-d"} {
+		path = filepath.Join(srcPath, filepath.FromSlash(path))
+		err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(path), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Mkdir(filepath.Join(srcPath, "empty"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		Sources:          []Source{{Path: srcPath}},
+		SortEntries:      true,
+		IncludeEmptyDirs: true,
+	}
+
+	first := zipEntryNames(t, config)
+	second := zipEntryNames(t, config)
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("Entries differ between backups of the same files:\n%q\n%q", first, second)
+	}
+	if first[len(first)-1] != manifestName {
+		t.Fatalf("Last entry is %q, not the manifest.", first[len(first)-1])
+	}
+	entries := first[:len(first)-1]
+	if !sort.StringsAreSorted(entries) {
+		t.Fatalf("Entries aren't sorted by path: %q", entries)
+	}
+	if len(entries) != 9 {
+		t.Fatalf("Backed up %d entries, not 9: %q", len(entries), entries)
+	}
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	dirPath := t.TempDir()
+	srcPath := filepath.Join(dirPath, "src")
+	targetPath := filepath.Join(dirPath, "target")
+	for _, path := range []string{srcPath, targetPath} {
+		err := os.Mkdir(path, os.ModePerm)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.WriteFile(filepath.Join(targetPath, "a.txt"), []byte("a"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(targetPath, filepath.Join(srcPath, "link"))
+	if err != nil {
+		t.Skip("Unable to create symlinks:", err)
+	}
+
+	follow, dontFollow := true, false
+	tests := []struct {
+		followSymlinks *bool
+		want           string
+	}{
+		{nil, "source-1:-src/link/a.txt"},
+		{&follow, "source-1:-src/link/a.txt"},
+		{&dontFollow, "source-1:-src/link"},
+	}
+	for _, test := range tests {
+		names := zipEntryNames(t, Config{Sources: []Source{{Path: srcPath, FollowSymlinks: test.followSymlinks}}})
+		entries := names[:len(names)-1]
+		if len(entries) != 1 || entries[0] != test.want {
+			t.Errorf("Backed up %q, want only %q.", entries, test.want)
+		}
+	}
+}
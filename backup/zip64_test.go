@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"archive/zip"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Larger than the 32 bit sizes and offsets of zip headers can hold.
+const overZip32 = 1<<32 + 1<<20
+
+// Writes entries of `sizes` zero bytes, spooling those `spooled` returns true for, then checks the zip reads back with the right sizes and CRCs.
+// Entries are stored rather than deflated so their compressed sizes and offsets also need Zip64.
+func testZip64(t *testing.T, sizes []int64, spooled func(i int) bool) {
+	// Each test writes over 4 GiB to the temporary directory so they only run when asked for.
+	if os.Getenv("WFB_LARGE_TESTS") != "1" {
+		t.Skip("Writes over 4 GiB. Set WFB_LARGE_TESTS=1 to run.")
+	}
+	path := filepath.Join(t.TempDir(), "backup.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w := newWalker(zip.NewWriter(file), newErrorHandler(nil), &Config{}, Source{})
+	w.zipMu = &sync.Mutex{}
+	for i, size := range sizes {
+		header := &zip.FileHeader{Name: fmt.Sprintf("%d.bin", i), Method: zip.Store, Modified: time.Now()}
+		write := w.write
+		if spooled(i) {
+			write = w.writeSpooled
+		}
+		n, _, err := write(header, io.LimitReader(zeroReader{}, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != size {
+			t.Fatalf("Wrote %d bytes of %q, want %d.", n, header.Name, size)
+		}
+	}
+	err = w.zip.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if len(r.File) != len(sizes) {
+		t.Fatalf("Read %d entries, want %d.", len(r.File), len(sizes))
+	}
+	crcs := make(map[int64]uint32)
+	for i, f := range r.File {
+		size := sizes[i]
+		crc, ok := crcs[size]
+		if !ok {
+			hash := crc32.NewIEEE()
+			io.CopyN(hash, zeroReader{}, size)
+			crc = hash.Sum32()
+			crcs[size] = crc
+		}
+		if f.UncompressedSize64 != uint64(size) || f.CompressedSize64 != uint64(size) {
+			t.Fatalf("%q has sizes %d and %d, want %d.", f.Name, f.UncompressedSize64, f.CompressedSize64, size)
+		}
+		if f.CRC32 != crc {
+			t.Fatalf("%q has CRC %08x, want %08x.", f.Name, f.CRC32, crc)
+		}
+		// Reading to the end also checks the data against the CRC.
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := io.Copy(ioutil.Discard, rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("Unable to read %q: %s", f.Name, err)
+		}
+		if n != size {
+			t.Fatalf("Read %d bytes of %q, want %d.", n, f.Name, size)
+		}
+	}
+}
+
+func TestZip64File(t *testing.T) {
+	testZip64(t, []int64{overZip32, 1}, func(i int) bool {
+		return false
+	})
+}
+
+func TestZip64SpooledFile(t *testing.T) {
+	testZip64(t, []int64{overZip32, 1}, func(i int) bool {
+		return true
+	})
+}
+
+func TestZip64ManyEntries(t *testing.T) {
+	// The entries after the first 4 GiB start at offsets that need Zip64.
+	sizes := make([]int64, 0)
+	for total := int64(0); total < overZip32; total += 1 << 28 {
+		sizes = append(sizes, 1<<28)
+	}
+	sizes = append(sizes, 0, 1)
+	testZip64(t, sizes, func(i int) bool {
+		return i%2 == 0
+	})
+}
@@ -1,371 +1,337 @@
 package main
 
 import (
-	"archive/zip"
-	"encoding/json"
+	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
-	"path"
+	"os/signal"
 	"path/filepath"
-	"regexp"
-	"sort"
-	"strconv"
 	"strings"
+	"syscall"
 	"time"
-)
-
-type Source struct {
-	Path      string
-	Blacklist []string
-}
 
-type Contact struct {
-	Name  string `json:"name"`
-	Email string `json:"email"`
-}
+	"github.com/jkeveren/windows-files-backup/backup"
+)
 
-type configuration struct {
-	Name                string
-	SendGridEnable      bool
-	SendGridAPIKey      string
-	SendGridFromAddress string
-	SalesScribeAPIKey   string
-	SalesScribeEnable   bool
-	ErrorContacts       []Contact
-	Sources             []Source
-}
+// Exit codes. 0 means every backup succeeded without errors.
+const (
+	exitErrors = 1 // Errors occurred but every backup was written. Old backups were not deleted unless `PruneOnPartialSuccess` allowed it. Also used when restore, verify, list, prune, config-check or test-report find problems.
+	exitUsage  = 2 // Invalid arguments. Also used by the flag package.
+	exitFatal  = 3 // A backup was not written, e.g. due to an invalid config, a fatal error or an interruption.
+)
 
 func main() {
-	// Set up error handler
-	e := errorHandler{
-		logger: log.New(os.Stdout, "", 0),
+	dryRun := flag.Bool("dry-run", false, "List what would be backed up without writing a backup or deleting old backups.")
+	jobName := flag.String("job", "", "Name of the job to run. Every job is run when omitted.")
+	quiet := flag.Bool("quiet", false, "Only log to log.txt, not stdout, except for each backup's summary and the error that stopped it. Progress isn't logged.")
+	verbose := flag.Bool("verbose", false, "Log every file added to the backup and every path skipped, with the reason.")
+	var configPaths configPathsFlag
+	flag.Var(&configPaths, "config", "Path of the config file. Defaults to config.json in the destination directory. Repeat to layer configs, with later files overriding earlier ones.")
+	password := flag.String("password", os.Getenv("BACKUP_PASSWORD"), "Password for restoring or verifying encrypted backups. Defaults to the BACKUP_PASSWORD environment variable.")
+	flag.Parse()
+
+	l := log.New(os.Stdout, "", 0)
+
+	// Subcommands
+	switch flag.Arg(0) {
+	case "restore":
+		if flag.NArg() < 3 {
+			l.Print(errors.New("Not enough arguments. Usage: \"backup [--password <password>] restore <backup zip> <directory to restore to>\""))
+			os.Exit(exitUsage)
+		}
+		errs := backup.Restore(flag.Arg(1), *password, flag.Arg(2), l)
+		if len(errs) > 0 {
+			os.Exit(exitErrors)
+		}
+		return
+	case "config-check":
+		if flag.NArg() < 2 {
+			l.Print(errors.New("Not enough arguments. Usage: \"backup [--config <path>] config-check <directory to store backups>\""))
+			os.Exit(exitUsage)
+		}
+		err := backup.CheckConfigFiles(configPaths.orDefault(flag.Arg(1)), flag.Arg(1), l)
+		if err != nil {
+			os.Exit(exitErrors)
+		}
+		return
+	case "test-report":
+		if flag.NArg() < 2 {
+			l.Print(errors.New("Not enough arguments. Usage: \"backup [--config <path>] test-report <directory to store backups>\""))
+			os.Exit(exitUsage)
+		}
+		config, err := backup.LoadConfigFiles(configPaths.orDefault(flag.Arg(1)), flag.Arg(1))
+		if err != nil {
+			l.Print(err)
+			os.Exit(exitErrors)
+		}
+		config.Logger = l
+		errs := backup.TestReport(context.Background(), config)
+		if len(errs) > 0 {
+			os.Exit(exitErrors)
+		}
+		return
+	case "list", "prune":
+		if flag.NArg() < 2 {
+			l.Print(fmt.Errorf("Not enough arguments. Usage: \"backup [--config <path>] [--job <name>] %s <directory to store backups>\"", flag.Arg(0)))
+			os.Exit(exitUsage)
+		}
+		config, err := backup.LoadConfigFiles(configPaths.orDefault(flag.Arg(1)), flag.Arg(1))
+		if err != nil {
+			l.Print(err)
+			os.Exit(exitErrors)
+		}
+		configs, err := config.JobConfigs(*jobName)
+		if err != nil {
+			l.Print(err)
+			os.Exit(exitErrors)
+		}
+		code := 0
+		for _, jobConfig := range configs {
+			if len(configs) > 1 {
+				l.Printf("%s:", jobConfig.Name)
+			}
+			var errs []error
+			if flag.Arg(0) == "list" {
+				errs = backup.List(jobConfig, l)
+			} else {
+				errs = backup.Prune(jobConfig, l)
+			}
+			if len(errs) > 0 {
+				code = exitErrors
+			}
+		}
+		os.Exit(code)
+	case "verify":
+		if flag.NArg() < 2 {
+			l.Print(errors.New("Not enough arguments. Usage: \"backup [--password <password>] verify <backup zip>\""))
+			os.Exit(exitUsage)
+		}
+		errs := backup.Verify(flag.Arg(1), *password, l)
+		if len(errs) > 0 {
+			os.Exit(exitErrors)
+		}
+		return
 	}
-	var config configuration
-	defer report(&e, &config)
 
 	// Validate CLI args
-	if len(os.Args) < 2 {
-		// Don't panic because no trace is required.
-		e.print(errors.New("Not enough arguments. Usage: \"backup <directory to store backups>\""))
-		return
+	if flag.NArg() < 1 {
+		l.Print(errors.New("Not enough arguments. Usage: \"backup [--dry-run] [--quiet] [--verbose] [--job <name>] [--config <path>] <directory to store backups>\""))
+		os.Exit(exitUsage)
 	}
 
-	dstDirPath := os.Args[1]
-
-	// Configure logger
-	l, err := configureLogger(dstDirPath)
-	e.panicIfErr(err)
-	e.logger = l
-
-	// Get absolute path after establishing logs so error can be written to file.
-	dstDirPath, err = filepath.Abs(dstDirPath)
-	e.panicIfErr(err)
-
-	// Parse config
-	configJSON, err := ioutil.ReadFile(path.Join(dstDirPath, "config.json"))
-	e.panicIfErr(err)
-	err = json.Unmarshal(configJSON, &config)
-	e.panicIfErr(err)
-
-	// Create destination file name.
-	t := time.Now().UTC()
-	dstFileName := fmt.Sprintf("%d_UTC-%d-%d-%d.zip", t.Unix(), t.Year(), t.Month(), t.Day())
-	backupsDirPath := path.Join(dstDirPath, "backups")
-	dstFilePath := path.Join(backupsDirPath, dstFileName)
-
-	// Create backup dir if not exist.
-	err = os.Mkdir(backupsDirPath, os.ModeDir|os.ModePerm)
-	if err != nil && !os.IsExist(err) {
-		e.panic(err)
+	dstDirPath := flag.Arg(0)
+	// Allow flags after the directory too.
+	err := flag.CommandLine.Parse(flag.Args()[1:])
+	if err != nil {
+		os.Exit(exitUsage)
 	}
 
-	// Create destination file.
-	dstFile, err := os.Create(dstFilePath)
-	e.panicIfErr(err)
-	defer dstFile.Close()
-	dstZip := zip.NewWriter(dstFile)
-	defer dstZip.Close()
-
-	// Add sources to destination file.
-	for i, source := range config.Sources {
-		baseName := filepath.Base(source.Path)
-		errs := addSrc(dstZip, source.Path, fmt.Sprintf("source-%d:-%s", i+1, baseName), source.Blacklist) // include number for simple collision prevention
-		for _, err := range errs {
-			e.print(err)
-		}
-	}
+	// Parse config before configuring the logger because it configures log rotation.
+	// Errors are handled after establishing logs so they can be written to file.
+	config, configErr := backup.LoadConfigFiles(configPaths.orDefault(dstDirPath), dstDirPath)
 
-	// Delete old backups.
-	if len(e.errs) > 0 {
-		e.panic(errors.New("Errors occurred. Old backups will not be deleted automatically."))
-	}
-	format := "Unable to delete old backups: %s "
-	backupInfos, err := ioutil.ReadDir(backupsDirPath)
-	if err != nil {
-		e.panic(errors.New(format + err.Error()))
-	}
-	backupReg, err := regexp.Compile("^\\d{10}_UTC-\\d{4}-\\d{1,2}-\\d{1,2}")
+	// Configure logger
+	var fileLogger, errorLogger *log.Logger
+	var logOffset int64
+	fileLogger, errorLogger, logOffset, err = configureLogger(dstDirPath, config.LogMaxBytes, config.LogMaxFiles, config.LogFormat, *quiet)
 	if err != nil {
-		e.panic(errors.New(format + err.Error()))
-	}
-	backupNames := make([]string, 0)
-	for _, info := range backupInfos {
-		name := info.Name()
-		if backupReg.MatchString(name) {
-			backupNames = append(backupNames, name)
+		l.Print(err)
+		os.Exit(exitFatal)
+	}
+	config.Logger = fileLogger
+	config.ErrorLogger = errorLogger
+	config.LogPath = filepath.Join(dstDirPath, "log.txt")
+	config.LogOffset = logOffset
+	config.Quiet = *quiet
+	config.Verbose = *verbose
+
+	var configs []backup.Config
+	if configErr == nil {
+		configs, configErr = config.JobConfigs(*jobName)
+	}
+	if configErr != nil {
+		fileLogger.Print(configErr)
+		errorLogger.Print(configErr)
+		if *quiet {
+			l.Print(configErr)
 		}
+		// Dry runs are interactive so errors are only logged.
+		if !*dryRun {
+			backup.Report(context.Background(), config, backup.Result{Errors: []error{configErr}})
+		}
+		os.Exit(exitFatal)
 	}
-	sort.Strings(backupNames)
-	deleteCount := len(backupNames) - 3
-	if deleteCount < 0 {
-		deleteCount = 0
-	}
-	oldBackupNames := backupNames[:deleteCount]
-	for _, name := range oldBackupNames {
-		l.Printf("Deleting old backup %q", name)
-		err := os.Remove(path.Join(backupsDirPath, name))
-		e.printIfErr(err)
-	}
-
-	l.Print("Done.")
-}
 
-type errorHandler struct {
-	logger *log.Logger
-	errs   []error
-}
+	// Stop work on interrupt so the partial backup and lock are cleaned up.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
 
-func (e *errorHandler) print(err error) {
-	e.errs = append(e.errs, err)
-	e.logger.Print(err)
-}
+	// Run jobs one at a time so they don't compete for disk bandwidth.
+	code := 0
+	for _, jobConfig := range configs {
+		if ctx.Err() != nil {
+			break
+		}
+		if len(configs) > 1 {
+			fileLogger.Printf("Backing up %q.", jobConfig.Name)
+		}
 
-func (e *errorHandler) panic(err error) {
-	e.errs = append(e.errs, err)
-	e.logger.Panic(err)
-}
+		if *dryRun {
+			result, err := backup.DryRun(ctx, jobConfig)
+			code = worstExitCode(code, exitCode(result, err))
+			continue
+		}
 
-func (e *errorHandler) printIfErr(err error) {
-	if err != nil {
-		e.print(err)
+		result, err := backup.Run(ctx, jobConfig)
+		code = worstExitCode(code, exitCode(result, err))
+		// The log isn't written to stdout so surface the outcome.
+		if *quiet {
+			if err != nil {
+				l.Print(err)
+			}
+			l.Print(result.Summary())
+		}
+		// Report interruptions too. Stop catching signals first so a second interrupt stops the report.
+		if ctx.Err() != nil {
+			stopSignals()
+		}
+		// Errors are reported per job so each email is about one backups directory.
+		backup.Report(context.Background(), jobConfig, result)
 	}
-}
-
-func (e *errorHandler) panicIfErr(err error) {
-	if err != nil {
-		e.panic(err)
+	// Jobs after an interruption weren't run.
+	if ctx.Err() != nil {
+		code = exitFatal
 	}
+	os.Exit(code)
 }
 
-type salesScribeContact struct {
-	Name    string `json:"name"`
-	Address string `json:"address"`
-}
-
-// Reports errors via email.
-func report(e *errorHandler, config *configuration) {
-	if len(config.ErrorContacts) == 0 {
-		e.logger.Print("Warning: No error contacts were specified.")
-		return
+// Returns the exit code for the outcome of a backup or dry run.
+func exitCode(result backup.Result, err error) int {
+	if err == nil && len(result.Errors) == 0 {
+		return 0
 	}
-
-	// Only report if errors occurred.
-	if len(e.errs) == 0 {
-		e.logger.Print("No errors occurred.")
-		return
+	// `ArchivePath` is only set once the backup is complete.
+	if err != nil && result.ArchivePath == "" {
+		return exitFatal
 	}
+	return exitErrors
+}
 
-	subject := strconv.Quote("Errors while backing up " + config.Name)
-
-	// Concat all errors that occurred.
-	var errorsString string
-	for _, err := range e.errs {
-		errorsString += err.Error() + "\n"
+// Returns whichever exit code describes the worse outcome.
+func worstExitCode(a, b int) int {
+	if a > b {
+		return a
 	}
-	message := strconv.Quote(fmt.Sprintf("Errors occurred while backing up %s:\n%s", config.Name, errorsString))
+	return b
+}
 
-	if config.SalesScribeEnable {
-		e.logger.Print("Sending error email via SalesScribe.")
-		err := salesScribe(config, subject, message)
+// Create logger that appends to file and writes to stdout, and a logger for errors only that writes to `errors.txt`.
+// `errors.txt` only contains errors from the latest run. Also returns the size of the log file before this run.
+// If `maxBytes` is positive, the log file is rotated once it reaches `maxBytes`, keeping `maxFiles` old files.
+// If `quiet` is set, the logger only writes to file.
+// `format` is "text" or "json". Empty means "text".
+func configureLogger(dstDirPath string, maxBytes int64, maxFiles int, format string, quiet bool) (*log.Logger, *log.Logger, int64, error) {
+	if format != "" && format != "text" && format != "json" {
+		return nil, nil, 0, fmt.Errorf("Invalid logFormat %q. Must be \"text\" or \"json\".", format)
+	}
+	logFilePath := filepath.Join(dstDirPath, "log.txt")
+	if maxBytes > 0 {
+		err := rotateLog(dstDirPath, maxBytes, maxFiles)
 		if err != nil {
-			e.logger.Print(err.Error());
+			return nil, nil, 0, err
 		}
 	}
-
-	if config.SendGridEnable {
-		e.logger.Print("Sending error email via SendGrid.")
-		err := sendGrid(config, subject, message)
-		if err != nil {
-			e.logger.Print(err.Error())
-		}
+	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0755)
+	if err != nil {
+		return nil, nil, 0, err
 	}
-}
-
-func salesScribe(config *configuration, subject, message string) error {
-	if config.SalesScribeAPIKey == "" {
-		return errors.New("No SalesScribe API key for report email.");
+	logInfo, err := logFile.Stat()
+	if err != nil {
+		return nil, nil, 0, err
 	}
-
-	contactCount := len(config.ErrorContacts)
-	contacts := make([]salesScribeContact, contactCount, contactCount)
-	for i, contact := range config.ErrorContacts {
-		contacts[i] = salesScribeContact{
-			Name:    contact.Name,
-			Address: contact.Email,
-		}
+	logOffset := logInfo.Size()
+	var lw io.Writer = io.MultiWriter(logFile, os.Stdout)
+	if quiet {
+		lw = logFile
 	}
 
-	// Marshal contacts.
-	contactsBytes, err := json.MarshalIndent(contacts, "", "\t")
+	// Errors are also written to the main logger so this doesn't write to stdout.
+	var errorWriter io.Writer
+	errorWriter, err = os.Create(filepath.Join(dstDirPath, "errors.txt"))
 	if err != nil {
-		return err
+		return nil, nil, 0, err
 	}
-	contactsString := string(contactsBytes)
 
-	// Create SendGrid request body.
-	requestBodyString := `{
-		"DynamicDataJson": ` + strconv.Quote(`{"email": ` + strconv.Quote(config.ErrorContacts[0].Email) + `, "fullName": ` + strconv.Quote(config.ErrorContacts[0].Name) + `, "subject": ` + subject + `, "message": ` + message + `}`) + `,
-		"ToAddresses": ` + contactsString + `
-	}`
-
-	// Make SendGrid request.
-	request, err := http.NewRequest("POST", "https://integrate.salesscribe.com/v1", strings.NewReader(requestBodyString))
-	if err != nil {
-		return err
+	if format == "json" {
+		// The JSON has its own time field.
+		l := log.New(backup.NewJSONLogWriter(lw), "", log.Lshortfile)
+		l.Print("Run started.")
+		errorLogger := log.New(backup.NewJSONLogWriter(errorWriter), "", log.Lshortfile)
+		return l, errorLogger, logOffset, nil
 	}
-	request.Header.Set("ApiKey2", config.SalesScribeAPIKey)
-	request.Header.Set("content-type", "application/json")
-	httpClient := &http.Client{}
-	response, err := httpClient.Do(request)
+
+	// Separate runs so they can be told apart in the file.
+	_, err = fmt.Fprintf(lw, "\n==== Run started %s ====\n", time.Now().Format(time.RFC3339))
 	if err != nil {
-		return err
-	}
-	// If status code is not 2xx.
-	if response.StatusCode/100 != 2 {
-		// Read body
-		responseBody, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			// Not critical; use failover body.
-			responseBody = []byte("Error retrieving response body")
-		}
-		return errors.New(fmt.Sprintf("SalesScribe returned non-200 status code \"%d\".\n\nReponse body: \"%s\".\n\nRequest body: \"%s\"", response.StatusCode, string(responseBody), requestBodyString))
+		return nil, nil, 0, err
 	}
-
-	return nil
+	l := log.New(lw, "", log.Ltime|log.Ldate|log.Lshortfile)
+	errorLogger := log.New(errorWriter, "", log.Ltime|log.Ldate|log.Lshortfile)
+	return l, errorLogger, logOffset, nil
 }
 
-func sendGrid(config *configuration, subject, message string) error {
-	if config.SendGridAPIKey == "" {
-		return errors.New("No SendGrid API key for report email.")
+// Renames `log.txt` to `log.1.txt` if it is at least `maxBytes`, shifting older logs up to `log.<maxFiles>.txt`.
+func rotateLog(dstDirPath string, maxBytes int64, maxFiles int) error {
+	logFilePath := filepath.Join(dstDirPath, "log.txt")
+	info, err := os.Stat(logFilePath)
+	if os.IsNotExist(err) {
+		return nil
 	}
-
-	// Marshal contacts.
-	contactsBytes, err := json.Marshal(config.ErrorContacts)
 	if err != nil {
 		return err
 	}
-	contactsString := string(contactsBytes)
-
-	// Create SendGrid request body.
-	requestBodyString := `{
-		"personalizations": [{"to": ` + contactsString + `}],
-		"from": {"email": ` + strconv.Quote(config.SendGridFromAddress) + `},
-		"subject": ` + subject + `,
-		"content": [{
-			"type": "text/plain",
-			"value": ` + message + `
-		}]
-	}`
-
-	// Make SendGrid request.
-	request, err := http.NewRequest("POST", "https://api.sendgrid.com/v3/mail/send", strings.NewReader(requestBodyString))
-	if err != nil {
-		return err
+	if info.Size() < maxBytes {
+		return nil
 	}
-	request.Header.Set("authorization", "Bearer "+config.SendGridAPIKey)
-	request.Header.Set("content-type", "application/json")
-	httpClient := &http.Client{}
-	response, err := httpClient.Do(request)
-	if err != nil {
+	if maxFiles <= 0 {
+		maxFiles = 3
+	}
+	rotatedPath := func(i int) string {
+		return filepath.Join(dstDirPath, fmt.Sprintf("log.%d.txt", i))
+	}
+	err = os.Remove(rotatedPath(maxFiles))
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	// If status code is not 2xx.
-	if response.StatusCode/100 != 2 {
-		// Read body
-		responseBody, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			// Not critical; use error body.
-			responseBody = []byte("Error reading response body")
+	for i := maxFiles - 1; i >= 1; i-- {
+		err := os.Rename(rotatedPath(i), rotatedPath(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
 		}
-		// Print SendGrid error.
-		return errors.New(fmt.Sprintf("SendGrid returned non-200 status code \"%d\".\n\nReponse body: \"%s\".\n\nRequest body: \"%s\"", response.StatusCode, string(responseBody), requestBodyString))
 	}
+	return os.Rename(logFilePath, rotatedPath(1))
+}
 
-	return nil
+// Collects every --config flag in order.
+type configPathsFlag []string
+
+func (c *configPathsFlag) String() string {
+	return strings.Join(*c, ", ")
 }
 
-// Create logger that writes to file and stdout.
-func configureLogger(dstDirPath string) (*log.Logger, error) {
-	logFilePath := path.Join(dstDirPath, "log.txt")
-	logFile, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
-	if err != nil {
-		return nil, err
-	}
-	lw := io.MultiWriter(logFile, os.Stdout)
-	l := log.New(lw, "", log.Ltime|log.Ldate|log.Lshortfile)
-	return l, nil
+func (c *configPathsFlag) Set(value string) error {
+	*c = append(*c, value)
+	return nil
 }
 
-// Backs up everything in `srcPath` to zip using `w`.
-func addSrc(w *zip.Writer, srcPath, dstPath string, blacklist []string) []error {
-	for _, pattern := range blacklist {
-		match, err := filepath.Match(pattern, filepath.Base(srcPath))
-		if err != nil {
-			return []error{err}
-		}
-		if match {
-			return []error{}
-		}
-	}
-	info, err := os.Stat(srcPath)
-	if err != nil {
-		return []error{err}
-	}
-	if info.IsDir() {
-		infos, err := ioutil.ReadDir(srcPath)
-		if err != nil {
-			return []error{err}
-		}
-		errs := make([]error, 0)
-		for _, info := range infos {
-			name := info.Name()
-			childSrcPath := path.Join(srcPath, name)
-			childDstPath := path.Join(dstPath, name)
-			childErrs := addSrc(w, childSrcPath, childDstPath, blacklist)
-			for _, err := range childErrs {
-				errs = append(errs, err)
-			}
-		}
-		return errs
-	} else {
-		src, err := os.Open(srcPath)
-		if err != nil {
-			return []error{err}
-		}
-		defer src.Close()
-		dst, err := w.Create(dstPath)
-		if err != nil {
-			return []error{err}
-		}
-		_, err = io.Copy(dst, src)
-		if err != nil {
-			return []error{err}
-		}
+// Returns the config paths, or `config.json` in `dstDirPath` if there are none.
+func (c configPathsFlag) orDefault(dstDirPath string) []string {
+	if len(c) == 0 {
+		return []string{filepath.Join(dstDirPath, "config.json")}
 	}
-	return []error{}
+	return c
 }